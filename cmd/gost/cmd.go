@@ -1,15 +1,25 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-gost/core/metadata"
 	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/recorder"
 	"github.com/go-gost/x/config"
 	xlimiter "github.com/go-gost/x/limiter"
 	mdx "github.com/go-gost/x/metadata"
@@ -34,33 +44,49 @@ func (l *stringList) Set(value string) error {
 func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 	cfg := &config.Config{}
 
+	// the config files listed in GOST_CONFIG are the base of the command line config,
+	// the objects built from the command line are named after the ones in the base.
+	if v := os.Getenv("GOST_CONFIG"); v != "" {
+		base, err := loadConfigFiles(filepath.SplitList(v)...)
+		if err != nil {
+			return nil, err
+		}
+		cfg = base
+	}
+	names := configNames(cfg)
+
 	if v := os.Getenv("GOST_PROFILING"); v != "" {
 		cfg.Profiling = &config.ProfilingConfig{
 			Addr: v,
 		}
 	}
+	// the environment only sets the address and level, the rest of the base sections are kept.
 	if v := os.Getenv("GOST_METRICS"); v != "" {
-		cfg.Metrics = &config.MetricsConfig{
-			Addr: v,
+		if cfg.Metrics == nil {
+			cfg.Metrics = &config.MetricsConfig{}
 		}
+		cfg.Metrics.Addr = v
 	}
 
 	if v := os.Getenv("GOST_LOGGER_LEVEL"); v != "" {
-		cfg.Log = &config.LogConfig{
-			Level: v,
+		if cfg.Log == nil {
+			cfg.Log = &config.LogConfig{}
 		}
+		cfg.Log.Level = v
 	}
 
 	if v := os.Getenv("GOST_API"); v != "" {
-		cfg.API = &config.APIConfig{
-			Addr: v,
+		apiCfg, err := apiConfig(v)
+		if err != nil {
+			return nil, err
 		}
+		cfg.API = apiCfg
 	}
 
 	var chain *config.ChainConfig
 	if len(nodes) > 0 {
 		chain = &config.ChainConfig{
-			Name: "chain-0",
+			Name: names.next("chain", len(cfg.Chains)),
 		}
 		cfg.Chains = append(cfg.Chains, chain)
 	}
@@ -86,21 +112,35 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			*nodeCfg = *nodeConfig
 			nodeCfg.Name = fmt.Sprintf("node-%d", len(nodes))
 			nodeCfg.Addr = host
+			// each node uses its own hostname as the server name if not specified.
+			if tlsCfg := nodeConfig.Dialer.TLS; tlsCfg != nil && tlsCfg.ServerName == "" {
+				dialerCfg := *nodeConfig.Dialer
+				dialerCfg.TLS = &config.TLSConfig{}
+				*dialerCfg.TLS = *tlsCfg
+				if dialerCfg.TLS.ServerName, _, err = net.SplitHostPort(host); err != nil {
+					dialerCfg.TLS.ServerName = host
+				}
+				nodeCfg.Dialer = &dialerCfg
+			}
 			nodes = append(nodes, nodeCfg)
 		}
 
 		mc := nodeConfig.Connector.Metadata
 		md := mdx.NewMetadata(mc)
 
+		selector, err := parseSelector(mc)
+		if err != nil {
+			return nil, err
+		}
 		hopConfig := &config.HopConfig{
 			Name:     fmt.Sprintf("hop-%d", i),
-			Selector: parseSelector(mc),
+			Selector: selector,
 			Nodes:    nodes,
 		}
 
 		if v := mdutil.GetString(md, "bypass"); v != "" {
 			bypassCfg := &config.BypassConfig{
-				Name: fmt.Sprintf("bypass-%d", len(cfg.Bypasses)),
+				Name: names.next("bypass", len(cfg.Bypasses)),
 			}
 			if v[0] == '~' {
 				bypassCfg.Whitelist = true
@@ -118,7 +158,7 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		}
 		if v := mdutil.GetString(md, "resolver"); v != "" {
 			resolverCfg := &config.ResolverConfig{
-				Name: fmt.Sprintf("resolver-%d", len(cfg.Resolvers)),
+				Name: names.next("resolver", len(cfg.Resolvers)),
 			}
 			for _, rs := range strings.Split(v, ",") {
 				if rs == "" {
@@ -137,7 +177,7 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		}
 		if v := mdutil.GetString(md, "hosts"); v != "" {
 			hostsCfg := &config.HostsConfig{
-				Name: fmt.Sprintf("hosts-%d", len(cfg.Hosts)),
+				Name: names.next("hosts", len(cfg.Hosts)),
 			}
 			for _, s := range strings.Split(v, ",") {
 				ss := strings.SplitN(s, ":", 2)
@@ -168,6 +208,11 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			delete(mc, "so_mark")
 		}
 
+		for _, node := range nodes {
+			node.Connector.Metadata = routeMetadata(mc, "connector", "connector", "dialer")
+			node.Dialer.Metadata = routeMetadata(mc, "dialer", "connector", "dialer")
+		}
+
 		chain.Hops = append(chain.Hops, hopConfig)
 	}
 
@@ -177,29 +222,58 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			return nil, err
 		}
 
-		service, err := buildServiceConfig(url)
+		service, auths, err := buildServiceConfig(url)
+		if err != nil {
+			return nil, err
+		}
+		service.Name = names.next("service", i)
+		nsvcs := len(cfg.Services)
+
+		mh := service.Handler.Metadata
+		md := mdx.NewMetadata(mh)
+
+		// nochain=true or an empty chain= opts the service out of the chain.
+		nochain, err := parseBool(md, "nochain")
 		if err != nil {
 			return nil, err
 		}
-		service.Name = fmt.Sprintf("service-%d", i)
-		if chain != nil {
+		if v, ok := mh["chain"]; ok {
+			// the command line builds a single chain, it can not be selected by name.
+			if v != "" {
+				return nil, fmt.Errorf("%w: chain=%v, only an empty chain= is supported", ErrInvalidCmd, v)
+			}
+			nochain = true
+		}
+		delete(mh, "nochain")
+		delete(mh, "chain")
+
+		if chain != nil && !nochain {
 			if service.Listener.Type == "rtcp" || service.Listener.Type == "rudp" {
 				service.Listener.Chain = chain.Name
 			} else {
 				service.Handler.Chain = chain.Name
 			}
 		}
-		cfg.Services = append(cfg.Services, service)
 
-		mh := service.Handler.Metadata
-		md := mdx.NewMetadata(mh)
+		if len(auths) > 1 {
+			autherCfg := &config.AutherConfig{
+				Name:  names.next("auther", len(cfg.Authers)),
+				Auths: auths,
+			}
+			if service.Listener.Type == "ssh" || service.Listener.Type == "sshd" {
+				service.Listener.Auther = autherCfg.Name
+			} else {
+				service.Handler.Auther = autherCfg.Name
+			}
+			cfg.Authers = append(cfg.Authers, autherCfg)
+		}
 		if v := mdutil.GetInt(md, "retries"); v > 0 {
 			service.Handler.Retries = v
 			delete(mh, "retries")
 		}
 		if v := mdutil.GetString(md, "admission"); v != "" {
 			admCfg := &config.AdmissionConfig{
-				Name: fmt.Sprintf("admission-%d", len(cfg.Admissions)),
+				Name: names.next("admission", len(cfg.Admissions)),
 			}
 			if v[0] == '~' {
 				admCfg.Whitelist = true
@@ -217,7 +291,7 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		}
 		if v := mdutil.GetString(md, "bypass"); v != "" {
 			bypassCfg := &config.BypassConfig{
-				Name: fmt.Sprintf("bypass-%d", len(cfg.Bypasses)),
+				Name: names.next("bypass", len(cfg.Bypasses)),
 			}
 			if v[0] == '~' {
 				bypassCfg.Whitelist = true
@@ -235,7 +309,7 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		}
 		if v := mdutil.GetString(md, "resolver"); v != "" {
 			resolverCfg := &config.ResolverConfig{
-				Name: fmt.Sprintf("resolver-%d", len(cfg.Resolvers)),
+				Name: names.next("resolver", len(cfg.Resolvers)),
 			}
 			for _, rs := range strings.Split(v, ",") {
 				if rs == "" {
@@ -255,7 +329,7 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		}
 		if v := mdutil.GetString(md, "hosts"); v != "" {
 			hostsCfg := &config.HostsConfig{
-				Name: fmt.Sprintf("hosts-%d", len(cfg.Hosts)),
+				Name: names.next("hosts", len(cfg.Hosts)),
 			}
 			for _, s := range strings.Split(v, ",") {
 				ss := strings.SplitN(s, ":", 2)
@@ -275,36 +349,132 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			delete(mh, "hosts")
 		}
 
-		in := mdutil.GetString(md, "limiter.rate.in")
-		out := mdutil.GetString(md, "limiter.rate.out")
-		cin := mdutil.GetString(md, "limiter.rate.conn.in")
-		cout := mdutil.GetString(md, "limiter.rate.conn.out")
-		if in != "" || cin != "" {
-			limiter := &config.LimiterConfig{
-				Name: fmt.Sprintf("limiter-%d", len(cfg.Limiters)),
-				Rate: &config.RateLimiterConfig{},
-			}
-			if in != "" {
-				limiter.Rate.Limits = append(limiter.Rate.Limits,
-					fmt.Sprintf("%s %s %s", xlimiter.GlobalLimitKey, in, out))
-			}
-			if cin != "" {
-				limiter.Rate.Limits = append(limiter.Rate.Limits,
-					fmt.Sprintf("%s %s %s", xlimiter.ConnLimitKey, cin, cout))
+		if v := mdutil.GetString(md, "recorder"); v != "" {
+			for _, s := range strings.Split(v, ",") {
+				if s == "" {
+					continue
+				}
+				recorderCfg, err := parseRecorder(s)
+				if err != nil {
+					return nil, err
+				}
+				recorderCfg.Name = names.next("recorder", len(cfg.Recorders))
+				service.Recorders = append(service.Recorders, &config.RecorderObject{
+					Name:   recorderCfg.Name,
+					Record: recorder.RecorderServiceClientAddress,
+				})
+				cfg.Recorders = append(cfg.Recorders, recorderCfg)
 			}
+			delete(mh, "recorder")
+		}
+
+		if limiter := parseRateLimiter(mh); limiter != nil {
+			limiter.Name = names.next("limiter", len(cfg.Limiters))
 			service.Limiter = limiter.Name
 			cfg.Limiters = append(cfg.Limiters, limiter)
-			delete(mh, "limiter.rate.in")
-			delete(mh, "limiter.rate.out")
-			delete(mh, "limiter.rate.conn.in")
-			delete(mh, "limiter.rate.conn.out")
+		}
+
+		service.Handler.Metadata = routeMetadata(mh, "handler", "handler", "listener")
+		service.Listener.Metadata = routeMetadata(mh, "listener", "handler", "listener")
+		service.Metadata = routeMetadata(mh, "", "handler", "listener")
+
+		addrs, err := expandAddrs(service.Addr)
+		if err != nil {
+			return nil, err
+		}
+		// one service per listen address
+		for _, addr := range addrs {
+			svcCfg := &config.ServiceConfig{}
+			*svcCfg = *service
+			handlerCfg := *service.Handler
+			svcCfg.Handler = &handlerCfg
+			listenerCfg := *service.Listener
+			svcCfg.Listener = &listenerCfg
+
+			svcCfg.Addr = addr
+			if n := len(cfg.Services) - nsvcs; n > 0 {
+				svcCfg.Name = names.next(service.Name, n)
+			}
+			cfg.Services = append(cfg.Services, svcCfg)
 		}
 	}
 
+	if err := checkChainDepth(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCmd, err)
+	}
+
 	return cfg, nil
 }
 
-func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
+// nameSet is the set of the object names in a config.
+type nameSet map[string]bool
+
+func configNames(cfg *config.Config) nameSet {
+	names := nameSet{}
+	for _, c := range cfg.Services {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Chains {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Authers {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Admissions {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Bypasses {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Resolvers {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Hosts {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Recorders {
+		names[c.Name] = true
+	}
+	for _, c := range cfg.Limiters {
+		names[c.Name] = true
+	}
+	return names
+}
+
+// next returns the first unused name in the form of prefix-N with N >= n, and adds it to the set.
+func (s nameSet) next(prefix string, n int) string {
+	for ; ; n++ {
+		name := fmt.Sprintf("%s-%d", prefix, n)
+		if !s[name] {
+			s[name] = true
+			return name
+		}
+	}
+}
+
+// apiConfig returns the API config for the address addr,
+// with the settings of GOST_API_PATHPREFIX, GOST_API_ACCESSLOG and GOST_API_AUTH.
+func apiConfig(addr string) (*config.APIConfig, error) {
+	cfg := &config.APIConfig{
+		Addr:       addr,
+		PathPrefix: os.Getenv("GOST_API_PATHPREFIX"),
+	}
+	if v := os.Getenv("GOST_API_ACCESSLOG"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid GOST_API_ACCESSLOG %s", ErrInvalidCmd, v)
+		}
+		cfg.AccessLog = b
+	}
+	if v := os.Getenv("GOST_API_AUTH"); v != "" {
+		cfg.Auth = parseAuthFromCmd(v)
+	}
+	return cfg, nil
+}
+
+// buildServiceConfig builds the service config from the url,
+// the credentials are also returned, more than one of them requires an auther.
+func buildServiceConfig(url *url.URL) (*config.ServiceConfig, []*config.AuthConfig, error) {
 	var handler, listener string
 	schemes := strings.Split(url.Scheme, "+")
 	if len(schemes) == 1 {
@@ -320,10 +490,17 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 		Addr: url.Host,
 	}
 
-	if h := registry.HandlerRegistry().Get(handler); h == nil {
+	h := registry.HandlerRegistry().Get(handler)
+	ln := registry.ListenerRegistry().Get(listener)
+	if len(schemes) == 1 && h == nil && ln == nil ||
+		len(schemes) == 2 && (h == nil && handler != "auto" || ln == nil) {
+		return nil, nil, fmt.Errorf("%w: unknown scheme %s", ErrInvalidCmd, url.Scheme)
+	}
+
+	if h == nil {
 		handler = "auto"
 	}
-	if ln := registry.ListenerRegistry().Get(listener); ln == nil {
+	if ln == nil {
 		listener = "tcp"
 		if handler == "ssu" {
 			listener = "udp"
@@ -354,14 +531,6 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 		}
 	}
 
-	var auth *config.AuthConfig
-	if url.User != nil {
-		auth = &config.AuthConfig{
-			Username: url.User.Username(),
-		}
-		auth.Password, _ = url.User.Password()
-	}
-
 	m := map[string]any{}
 	for k, v := range url.Query() {
 		if len(v) > 0 {
@@ -370,14 +539,33 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 	}
 	md := mdx.NewMetadata(m)
 
-	if sa := mdutil.GetString(md, "auth"); sa != "" {
-		au, err := parseAuthFromCmd(sa)
-		if err != nil {
-			return nil, err
+	if err := checkUnsupported(m, unsupportedServiceOptions); err != nil {
+		return nil, nil, err
+	}
+
+	// the auth option can be repeated or comma-separated for multiple users,
+	// it overrides the user info of the URL.
+	var auths []*config.AuthConfig
+	for _, sa := range url.Query()["auth"] {
+		for _, s := range strings.Split(sa, ",") {
+			if s == "" {
+				continue
+			}
+			auths = append(auths, parseAuthFromCmd(s))
 		}
-		auth = au
 	}
 	delete(m, "auth")
+	if len(auths) == 0 && url.User != nil {
+		auth := &config.AuthConfig{
+			Username: url.User.Username(),
+		}
+		auth.Password, _ = url.User.Password()
+		auths = append(auths, auth)
+	}
+	var auth *config.AuthConfig
+	if len(auths) == 1 {
+		auth = auths[0]
+	}
 
 	tlsConfig := &config.TLSConfig{
 		CertFile: mdutil.GetString(md, "certFile"),
@@ -393,6 +581,13 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 	if tlsConfig.CAFile == "" {
 		tlsConfig.CAFile = mdutil.GetString(md, "ca")
 	}
+	for _, file := range []*string{&tlsConfig.CertFile, &tlsConfig.KeyFile, &tlsConfig.CAFile} {
+		v, err := loadPEMFile(*file)
+		if err != nil {
+			return nil, nil, err
+		}
+		*file = v
+	}
 
 	delete(m, "certFile")
 	delete(m, "cert")
@@ -405,12 +600,61 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 		tlsConfig = nil
 	}
 
+	if watch, err := parseBool(md, "tls.watch"); err != nil {
+		return nil, nil, err
+	} else if watch && tlsConfig == nil {
+		return nil, nil, fmt.Errorf("%w: tls.watch requires a certificate file", ErrInvalidCmd)
+	}
+
+	// the TLS listeners use the default TLS versions, they can not be restricted per service.
+	for _, k := range []string{"tls.clientMinVersion", "tls.clientMaxVersion"} {
+		if v := mdutil.GetString(md, k); v != "" {
+			return nil, nil, fmt.Errorf("%w: unsupported %s %s", ErrInvalidCmd, k, v)
+		}
+	}
+
+	// the TLS listeners always require and verify the client certificate if a CA file is set,
+	// and never ask for it otherwise, so the other client auth modes can not be honored.
+	switch v := mdutil.GetString(md, "tls.clientAuth"); v {
+	case "":
+	case "requireAndVerify":
+		if tlsConfig == nil || tlsConfig.CAFile == "" {
+			return nil, nil, fmt.Errorf("%w: tls.clientAuth %s requires a CA file", ErrInvalidCmd, v)
+		}
+		delete(m, "tls.clientAuth")
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported tls.clientAuth %s", ErrInvalidCmd, v)
+	}
+
+	// the TLS listeners do not check the revocation status of the client certificates.
+	switch v := mdutil.GetString(md, "tls.clientRevocation"); v {
+	case "", "none":
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported tls.clientRevocation %s", ErrInvalidCmd, v)
+	}
+
+	// the handlers can not detect the protocol downgrade.
+	enforce, err := parseBool(md, "https.enforce")
+	if err != nil {
+		return nil, nil, err
+	}
+	if enforce {
+		return nil, nil, fmt.Errorf("%w: unsupported https.enforce", ErrInvalidCmd)
+	}
+
 	if v := mdutil.GetString(md, "dns"); v != "" {
 		md.Set("dns", strings.Split(v, ","))
 	}
+	if err := parseUDPOptions(m, handler, listener); err != nil {
+		return nil, nil, err
+	}
 
 	if svc.Forwarder != nil {
-		svc.Forwarder.Selector = parseSelector(m)
+		selector, err := parseSelector(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		svc.Forwarder.Selector = selector
 	}
 
 	svc.Handler = &config.HandlerConfig{
@@ -431,7 +675,7 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 		svc.Listener.Auth = auth
 	}
 
-	return svc, nil
+	return svc, auths, nil
 }
 
 func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
@@ -450,10 +694,17 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 		Addr: url.Host,
 	}
 
-	if c := registry.ConnectorRegistry().Get(connector); c == nil {
+	c := registry.ConnectorRegistry().Get(connector)
+	d := registry.DialerRegistry().Get(dialer)
+	if len(schemes) == 1 && c == nil && d == nil && connector != "auto" ||
+		len(schemes) == 2 && (c == nil || d == nil) {
+		return nil, fmt.Errorf("%w: unknown scheme %s", ErrInvalidCmd, url.Scheme)
+	}
+
+	if c == nil {
 		connector = "http"
 	}
-	if d := registry.DialerRegistry().Get(dialer); d == nil {
+	if d == nil {
 		dialer = "tcp"
 		if connector == "ssu" {
 			dialer = "udp"
@@ -476,12 +727,12 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	}
 	md := mdx.NewMetadata(m)
 
+	if err := checkUnsupported(m, unsupportedNodeOptions); err != nil {
+		return nil, err
+	}
+
 	if sauth := mdutil.GetString(md, "auth"); sauth != "" && auth == nil {
-		au, err := parseAuthFromCmd(sauth)
-		if err != nil {
-			return nil, err
-		}
-		auth = au
+		auth = parseAuthFromCmd(sauth)
 	}
 	delete(m, "auth")
 
@@ -492,9 +743,6 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 		Secure:     mdutil.GetBool(md, "secure"),
 		ServerName: mdutil.GetString(md, "serverName"),
 	}
-	if tlsConfig.ServerName == "" {
-		tlsConfig.ServerName = url.Hostname()
-	}
 	if tlsConfig.CertFile == "" {
 		tlsConfig.CertFile = mdutil.GetString(md, "cert")
 	}
@@ -504,6 +752,13 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	if tlsConfig.CAFile == "" {
 		tlsConfig.CAFile = mdutil.GetString(md, "ca")
 	}
+	for _, file := range []*string{&tlsConfig.CertFile, &tlsConfig.KeyFile, &tlsConfig.CAFile} {
+		v, err := loadPEMFile(*file)
+		if err != nil {
+			return nil, err
+		}
+		*file = v
+	}
 
 	delete(m, "certFile")
 	delete(m, "cert")
@@ -543,42 +798,325 @@ func normCmd(s string) (*url.URL, error) {
 		return nil, ErrInvalidCmd
 	}
 
+	s, err := expandEnv(s)
+	if err != nil {
+		return nil, err
+	}
+
 	if s[0] == ':' || !strings.Contains(s, "://") {
 		s = "auto://" + s
 	}
 
+	// url.Parse does not accept a comma-separated address list or a port range as the host,
+	// so parse the URL with a placeholder host and restore the host afterwards.
+	var hosts string
+	n := strings.Index(s, "://") + 3
+	if end := strings.IndexAny(s[n:], "/?#"); end >= 0 {
+		hosts = s[n : n+end]
+	} else {
+		hosts = s[n:]
+	}
+	if at := strings.LastIndexByte(hosts, '@'); at >= 0 {
+		n += at + 1
+		hosts = hosts[at+1:]
+	}
+	if strings.ContainsAny(hosts, ",-") {
+		s = s[:n] + "localhost" + s[n+len(hosts):]
+	} else {
+		hosts = ""
+	}
+
 	url, err := url.Parse(s)
 	if err != nil {
 		return nil, err
 	}
+	if hosts != "" {
+		url.Host = hosts
+	}
+	// x has no https handler, listener, connector or dialer,
+	// so https is always served and dialed as http over tls.
 	if url.Scheme == "https" {
+		log.Debugf("rewrite scheme https to http+tls: %s", url.Redacted())
 		url.Scheme = "http+tls"
 	}
 
 	return url, nil
 }
 
-func parseAuthFromCmd(sa string) (*config.AuthConfig, error) {
-	v, err := base64.StdEncoding.DecodeString(sa)
-	if err != nil {
-		return nil, err
+// expandEnv replaces ${VAR} or $VAR in s with the value of the environment variable,
+// a literal $ can be written as $$. Only valid names are expanded,
+// the other uses of $, such as the shell special parameters $1 or $?, are kept as written.
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	var err error
+	lookup := func(name string) {
+		v, ok := os.LookupEnv(name)
+		if !ok && strictEnv && err == nil {
+			err = fmt.Errorf("%w: undefined environment variable %s", ErrInvalidCmd, name)
+		}
+		b.WriteString(v)
 	}
-	cs := string(v)
-	n := strings.IndexByte(cs, ':')
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch rest := s[i+1:]; {
+		case rest[0] == '$':
+			b.WriteByte('$')
+			i++
+		case rest[0] == '{':
+			if n := strings.IndexByte(rest, '}'); n > 1 && envNameLen(rest[1:n]) == n-1 {
+				lookup(rest[1:n])
+				i += n + 1
+				continue
+			}
+			b.WriteByte('$')
+		default:
+			if n := envNameLen(rest); n > 0 {
+				lookup(rest[:n])
+				i += n
+				continue
+			}
+			b.WriteByte('$')
+		}
+	}
+	s = b.String()
+	if err == nil && s == "" {
+		err = ErrInvalidCmd
+	}
+	return s, err
+}
+
+// envNameLen returns the length of the environment variable name at the start of s.
+func envNameLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		return i
+	}
+	return len(s)
+}
+
+// loadPEMFile returns the path of the PEM file specified by s.
+// s can be a file path, env:VAR_NAME to read the PEM data from the environment variable,
+// or pem:BASE64 for the inline base64 encoded PEM data,
+// the PEM data is written to a private temporary file named by its content.
+func loadPEMFile(s string) (string, error) {
+	var data []byte
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		data = []byte(os.Getenv(s[4:]))
+	case strings.HasPrefix(s, "pem:"):
+		b, err := base64.StdEncoding.DecodeString(s[4:])
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid PEM data: %v", ErrInvalidCmd, err)
+		}
+		data = b
+	default:
+		return s, nil
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		return "", fmt.Errorf("%w: no PEM data found in %s", ErrInvalidCmd, s[:4])
+	}
+
+	return writePEMFile(data)
+}
+
+// pemFiles is the directory of the PEM files written by writePEMFile,
+// it is created on the first use and removed by removePEMFiles.
+var pemFiles struct {
+	sync.Mutex
+	dir string
+}
+
+// writePEMFile writes data to a file named by the hash of data,
+// so the same data is always written to the same file.
+func writePEMFile(data []byte) (string, error) {
+	pemFiles.Lock()
+	defer pemFiles.Unlock()
+
+	if pemFiles.dir == "" {
+		dir, err := os.MkdirTemp("", "gost-")
+		if err != nil {
+			return "", err
+		}
+		pemFiles.dir = dir
+	}
+
+	sum := sha256.Sum256(data)
+	file := filepath.Join(pemFiles.dir, hex.EncodeToString(sum[:])+".pem")
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// removePEMFiles removes the PEM files written by writePEMFile.
+func removePEMFiles() {
+	pemFiles.Lock()
+	defer pemFiles.Unlock()
+
+	if pemFiles.dir != "" {
+		os.RemoveAll(pemFiles.dir)
+		pemFiles.dir = ""
+	}
+}
+
+// parseAuthFromCmd parses the base64 (standard or URL-safe, with or without padding)
+// encoded auth info, or the plain username:password.
+// The value of the query parameter is already percent-decoded, it must not be unescaped again.
+func parseAuthFromCmd(sa string) *config.AuthConfig {
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		if v, err := enc.DecodeString(sa); err == nil && utf8.Valid(v) {
+			return parseAuth(string(v))
+		}
+	}
+
+	return parseAuth(sa)
+}
+
+// parseAuth parses the auth info in the form of username[:password].
+func parseAuth(s string) *config.AuthConfig {
+	n := strings.IndexByte(s, ':')
 	if n < 0 {
 		return &config.AuthConfig{
-			Username: cs,
-		}, nil
+			Username: s,
+		}
 	}
 
 	return &config.AuthConfig{
-		Username: cs[:n],
-		Password: cs[n+1:],
+		Username: s[:n],
+		Password: s[n+1:],
+	}
+}
+
+// parseRecorder parses a recorder in the form of file:/path/to/file or redis://addr/key.
+func parseRecorder(s string) (*config.RecorderConfig, error) {
+	if path := strings.TrimPrefix(s, "file:"); path != s {
+		if path == "" {
+			return nil, fmt.Errorf("%w: invalid recorder %s", ErrInvalidCmd, s)
+		}
+		return &config.RecorderConfig{
+			File: &config.FileRecorder{
+				Path: path,
+			},
+		}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid recorder %s", ErrInvalidCmd, s)
+	}
+	rc := &config.RedisRecorder{
+		Addr: u.Host,
+		Key:  strings.Trim(u.Path, "/"),
+	}
+	if u.User != nil {
+		rc.Password, _ = u.User.Password()
+	}
+	return &config.RecorderConfig{
+		Redis: rc,
 	}, nil
 }
 
-func parseSelector(m map[string]any) *config.SelectorConfig {
+// parseUDPOptions maps the udp.* options to the metadata of the UDP-family services,
+// they are ignored for other services.
+func parseUDPOptions(m map[string]any, handler, listener string) error {
+	md := mdx.NewMetadata(m)
+	ttl, err := parseDuration(md, "udp.ttl")
+	if err != nil {
+		return err
+	}
+	bufferSize, err := parseInt(md, "udp.bufferSize")
+	if err != nil {
+		return err
+	}
+	queueSize, err := parseInt(md, "udp.readQueueSize")
+	if err != nil {
+		return err
+	}
+	if bufferSize < 0 || queueSize < 0 {
+		return fmt.Errorf("%w: invalid udp options", ErrInvalidCmd)
+	}
+
+	delete(m, "udp.ttl")
+	delete(m, "udp.bufferSize")
+	delete(m, "udp.readQueueSize")
+
+	if ttl == 0 && bufferSize == 0 && queueSize == 0 {
+		return nil
+	}
+
+	switch {
+	case handler == "udp", handler == "rudp", handler == "dns", handler == "ssu",
+		listener == "udp", listener == "rudp", listener == "dns":
+	default:
+		log.Warnf("udp options are ignored for %s+%s", handler, listener)
+		return nil
+	}
+
+	if ttl > 0 {
+		// the dns handler takes ttl as the TTL of the cached answers, not the session timeout.
+		if handler == "dns" || listener == "dns" {
+			log.Warnf("udp.ttl is ignored for %s+%s", handler, listener)
+		} else {
+			m["ttl"] = ttl.String()
+		}
+	}
+	if bufferSize > 0 {
+		m["readBufferSize"] = bufferSize
+	}
+	if queueSize > 0 {
+		m["readQueueSize"] = queueSize
+	}
+	return nil
+}
+
+func parseRateLimiter(m map[string]any) *config.LimiterConfig {
+	md := mdx.NewMetadata(m)
+	in := mdutil.GetString(md, "limiter.rate.in")
+	out := mdutil.GetString(md, "limiter.rate.out")
+	cin := mdutil.GetString(md, "limiter.rate.conn.in")
+	cout := mdutil.GetString(md, "limiter.rate.conn.out")
+	if in == "" && cin == "" {
+		return nil
+	}
+
+	limiter := &config.LimiterConfig{
+		Rate: &config.RateLimiterConfig{},
+	}
+	if in != "" {
+		limiter.Rate.Limits = append(limiter.Rate.Limits,
+			fmt.Sprintf("%s %s %s", xlimiter.GlobalLimitKey, in, out))
+	}
+	if cin != "" {
+		limiter.Rate.Limits = append(limiter.Rate.Limits,
+			fmt.Sprintf("%s %s %s", xlimiter.ConnLimitKey, cin, cout))
+	}
+
+	delete(m, "limiter.rate.in")
+	delete(m, "limiter.rate.out")
+	delete(m, "limiter.rate.conn.in")
+	delete(m, "limiter.rate.conn.out")
+
+	return limiter
+}
+
+func parseSelector(m map[string]any) (*config.SelectorConfig, error) {
 	md := mdx.NewMetadata(m)
+
 	strategy := mdutil.GetString(md, "strategy")
 	maxFails := mdutil.GetInt(md, "maxFails")
 	if maxFails == 0 {
@@ -589,10 +1127,15 @@ func parseSelector(m map[string]any) *config.SelectorConfig {
 		failTimeout = mdutil.GetDuration(md, "fail_timeout")
 	}
 	if strategy == "" && maxFails <= 0 && failTimeout <= 0 {
-		return nil
+		return nil, nil
 	}
-	if strategy == "" {
+	switch strategy {
+	case "":
 		strategy = "round"
+	// the strategies supported by the selector.
+	case "round", "rr", "random", "rand", "fifo", "ha":
+	default:
+		return nil, fmt.Errorf("%w: invalid strategy %s", ErrInvalidCmd, strategy)
 	}
 	if maxFails <= 0 {
 		maxFails = 1
@@ -611,5 +1154,211 @@ func parseSelector(m map[string]any) *config.SelectorConfig {
 		Strategy:    strategy,
 		MaxFails:    maxFails,
 		FailTimeout: failTimeout,
+	}, nil
+}
+
+// routeMetadata returns the metadata for the target.
+// The keys prefixed with the target (e.g. handler.X) are stripped of the prefix,
+// the keys prefixed with other targets are dropped, the other keys are kept.
+func routeMetadata(m map[string]any, target string, prefixes ...string) map[string]any {
+	md := map[string]any{}
+	var targeted []string
+	for k, v := range m {
+		prefixed := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(k, prefix+".") {
+				prefixed = true
+				if prefix == target {
+					targeted = append(targeted, k)
+				}
+			}
+		}
+		if !prefixed {
+			md[k] = v
+		}
+	}
+	// the targeted keys override the unprefixed ones.
+	for _, k := range targeted {
+		md[strings.TrimPrefix(k, target+".")] = m[k]
+	}
+	return md
+}
+
+// maxPortRange is the maximum number of ports in a port range.
+const maxPortRange = 1024
+
+// expandAddrs splits the comma-separated address list,
+// or expands the address with a port range (e.g. :20000-20010) to one address per port.
+func expandAddrs(s string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 1 {
+		for _, addr := range addrs {
+			if _, port, _ := net.SplitHostPort(addr); strings.Contains(port, "-") {
+				return nil, fmt.Errorf("%w: port range can not be used in address list %s", ErrInvalidCmd, s)
+			}
+		}
+	}
+	if len(addrs) != 1 {
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(addrs[0])
+	if err != nil || !strings.Contains(port, "-") {
+		return addrs, nil
+	}
+	min, max, err := parsePortRange(port)
+	if err != nil {
+		return nil, err
+	}
+	if max-min+1 > maxPortRange {
+		return nil, fmt.Errorf("%w: port range %s exceeds %d ports", ErrInvalidCmd, port, maxPortRange)
+	}
+	addrs = nil
+	for p := min; p <= max; p++ {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addrs, nil
+}
+
+// parsePortRange parses a port range in the form of min-max.
+func parsePortRange(s string) (min, max int, err error) {
+	ss := strings.SplitN(s, "-", 2)
+	min, err = strconv.Atoi(ss[0])
+	if err == nil {
+		max = min
+		if len(ss) == 2 {
+			max, err = strconv.Atoi(ss[1])
+		}
+	}
+	if err != nil || min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("%w: invalid port range %s", ErrInvalidCmd, s)
+	}
+	return
+}
+
+// unsupportedServiceOptions are the service options that no handler or listener applies,
+// they are rejected rather than silently ignored.
+var unsupportedServiceOptions = []string{
+	"limiter.adaptive",
+	"limiter.targetLatency",
+	"recorder.tag",
+	"dns.block",
+	"dns.sinkhole",
+	"limiter.conns",
+	"limiter.conns.perclient",
+	"loadShed",
+	"loadShed.threshold",
+	"alpnRoute",
+	"accept.rate",
+	"accept.burst",
+	"keepalive",
+	"rbuf",
+	"wbuf",
+	"trace.sample",
+	"tls.acceptTimeout",
+	"selector.recoveryRamp",
+	"observer.interval",
+	"http.abortPropagation",
+	"resolver.failAnswer",
+	"egressRoute",
+	"hc",
+	"hc.interval",
+	"hc.timeout",
+	"hc.path",
+	"resolver.maxInflight",
+	"idleClose",
+	"limiter.byAlpn",
+	"logSample",
+	"forwarder.hedge",
+	"quota.daily",
+	"quota.resetHour",
+	"idleTimeout",
+	"idleExtend",
+	"idleExtend.max",
+	"limiter.key",
+	"rewrite.host",
+	"rewrite.path",
+	"forwarder.drainGrace",
+	"relay.expect",
+	"resolver.serveStale",
+	"resolver.maxStale",
+	"compress.dict",
+	"accept.deadline",
+	"recorder.geoip",
+	"breaker.errorRate",
+	"breaker.window",
+	"authFailHandoff",
+	"maxGoroutines",
+	"mss",
+	"router.plugin",
+	"router.timeout",
+	"router.fallback",
+	"otel",
+	"otel.serviceName",
+	"otel.sample",
+	"http.dedupInflight",
+	"https.rewrite",
+}
+
+// unsupportedNodeOptions are the node options that no connector or dialer applies.
+var unsupportedNodeOptions = []string{
+	"limiter.rate.in",
+	"limiter.rate.out",
+	"limiter.rate.conn.in",
+	"limiter.rate.conn.out",
+	"egressPorts",
+	"selector.recoveryRamp",
+	"compress.dict",
+	"mss",
+	"https.rewrite",
+}
+
+func checkUnsupported(m map[string]any, unsupported []string) error {
+	for _, k := range unsupported {
+		if _, ok := m[k]; ok {
+			return fmt.Errorf("%w: unsupported %s", ErrInvalidCmd, k)
+		}
+	}
+	return nil
+}
+
+func parseBool(md metadata.Metadata, key string) (bool, error) {
+	v := mdutil.GetString(md, key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid %s %s", ErrInvalidCmd, key, v)
+	}
+	return b, nil
+}
+
+func parseInt(md metadata.Metadata, key string) (int, error) {
+	v := mdutil.GetString(md, key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %s", ErrInvalidCmd, key, v)
+	}
+	return n, nil
+}
+
+func parseDuration(md metadata.Metadata, key string) (time.Duration, error) {
+	v := mdutil.GetString(md, key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%w: invalid %s %s", ErrInvalidCmd, key, v)
 	}
+	return d, nil
 }
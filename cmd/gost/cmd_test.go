@@ -0,0 +1,723 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-gost/core/recorder"
+	"github.com/go-gost/x/config"
+)
+
+func TestBuildConfigFromCmdNode(t *testing.T) {
+	cfg, err := buildConfigFromCmd(stringList{":8080"}, stringList{"1.2.3.4:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Chains) != 1 || len(cfg.Chains[0].Hops) != 1 || len(cfg.Chains[0].Hops[0].Nodes) != 1 {
+		t.Fatalf("unexpected chains: %+v", cfg.Chains)
+	}
+	node := cfg.Chains[0].Hops[0].Nodes[0]
+	if node.Addr != "1.2.3.4:8080" {
+		t.Errorf("node addr: got %s, want 1.2.3.4:8080", node.Addr)
+	}
+	if node.Connector.Type != "http" || node.Dialer.Type != "tcp" {
+		t.Errorf("node type: got %s+%s, want http+tcp", node.Connector.Type, node.Dialer.Type)
+	}
+}
+
+func TestBuildConfigFromCmdNoChain(t *testing.T) {
+	tests := []struct {
+		svc      string
+		handler  string
+		listener string
+	}{
+		{svc: "http://:8080", handler: "chain-0"},
+		{svc: "http://:8080?nochain=true"},
+		{svc: "http://:8080?chain="},
+		{svc: "http://:8080?nochain=false", handler: "chain-0"},
+		{svc: "rtcp://:8080/:9090", listener: "chain-0"},
+		{svc: "rtcp://:8080/:9090?nochain=true"},
+		{svc: "rudp://:8080/:9090?chain="},
+	}
+	for _, tt := range tests {
+		cfg, err := buildConfigFromCmd(stringList{tt.svc}, stringList{"1.2.3.4:8080"})
+		if err != nil {
+			t.Errorf("%s: %v", tt.svc, err)
+			continue
+		}
+		svc := cfg.Services[0]
+		if svc.Handler.Chain != tt.handler || svc.Listener.Chain != tt.listener {
+			t.Errorf("%s: got handler chain %q and listener chain %q, want %q and %q",
+				tt.svc, svc.Handler.Chain, svc.Listener.Chain, tt.handler, tt.listener)
+		}
+		if _, ok := svc.Handler.Metadata["chain"]; ok {
+			t.Errorf("%s: chain is left in the metadata", tt.svc)
+		}
+		if _, ok := svc.Handler.Metadata["nochain"]; ok {
+			t.Errorf("%s: nochain is left in the metadata", tt.svc)
+		}
+	}
+
+	for _, svc := range []string{"http://:8080?chain=chain-1", "rtcp://:8080/:9090?chain=foo", "http://:8080?nochain=x"} {
+		if _, err := buildConfigFromCmd(stringList{svc}, stringList{"1.2.3.4:8080"}); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", svc, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildConfigFromCmdUnknownScheme(t *testing.T) {
+	tests := []struct {
+		services []string
+		nodes    []string
+	}{
+		{services: []string{"htpp://:8080"}},
+		{services: []string{"http+tlss://:8080"}},
+		{services: []string{":8080"}, nodes: []string{"sock5://1.2.3.4:1080"}},
+		{services: []string{":8080"}, nodes: []string{"socks5+tlss://1.2.3.4:1080"}},
+	}
+	for _, tt := range tests {
+		_, err := buildConfigFromCmd(tt.services, tt.nodes)
+		if !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%v %v: got error %v, want %v", tt.services, tt.nodes, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildServiceConfigClientAuth(t *testing.T) {
+	tests := []struct {
+		cmd string
+		ok  bool
+	}{
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem", ok: true},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientAuth=requireAndVerify", ok: true},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&tls.clientAuth=requireAndVerify"},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&tls.clientAuth=require"},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientAuth=none"},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientAuth=request"},
+		{cmd: "tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientAuth=verifyIfGiven"},
+	}
+	for _, tt := range tests {
+		u, err := normCmd(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = buildServiceConfig(u)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.cmd, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", tt.cmd, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildServiceConfigClientTLSVersion(t *testing.T) {
+	for _, cmd := range []string{
+		"tls://:8443?cert=cert.pem&key=key.pem&tls.clientMinVersion=1.3",
+		"tls://:8443?cert=cert.pem&key=key.pem&tls.clientMaxVersion=1.2",
+	} {
+		u, err := normCmd(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := buildServiceConfig(u); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", cmd, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildServiceConfigClientRevocation(t *testing.T) {
+	for _, cmd := range []string{
+		"tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientRevocation=crl&tls.crlFile=ca.crl",
+		"tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientRevocation=crl",
+		"tls://:8443?cert=cert.pem&key=key.pem&ca=ca.pem&tls.clientRevocation=ocsp",
+	} {
+		u, err := normCmd(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := buildServiceConfig(u); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", cmd, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestLoadPEMFile(t *testing.T) {
+	defer removePEMFiles()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")})
+	t.Setenv("GOST_TEST_CERT", string(data))
+
+	file, err := loadPEMFile("env:GOST_TEST_CERT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode: got %v, want 0600", fi.Mode().Perm())
+	}
+
+	// the same data is loaded from the same file.
+	file2, err := loadPEMFile("pem:" + base64.StdEncoding.EncodeToString(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file2 != file {
+		t.Errorf("got file %s, want %s", file2, file)
+	}
+
+	if _, err := loadPEMFile("pem:" + base64.StdEncoding.EncodeToString([]byte("cert"))); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCmd)
+	}
+
+	removePEMFiles()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s is not removed", file)
+	}
+}
+
+func TestParseAuthFromCmd(t *testing.T) {
+	const userinfo = "user:p>?~+/"
+	tests := []struct {
+		s        string
+		username string
+		password string
+	}{
+		{s: base64.StdEncoding.EncodeToString([]byte(userinfo)), username: "user", password: "p>?~+/"},
+		{s: base64.URLEncoding.EncodeToString([]byte(userinfo)), username: "user", password: "p>?~+/"},
+		{s: base64.RawStdEncoding.EncodeToString([]byte("user:pass1")), username: "user", password: "pass1"},
+		{s: base64.RawURLEncoding.EncodeToString([]byte("user:pass1")), username: "user", password: "pass1"},
+		{s: "user:pass", username: "user", password: "pass"},
+		{s: "user", username: "user"},
+	}
+	for _, tt := range tests {
+		auth := parseAuthFromCmd(tt.s)
+		if auth.Username != tt.username || auth.Password != tt.password {
+			t.Errorf("%s: got %s:%s, want %s:%s", tt.s, auth.Username, auth.Password, tt.username, tt.password)
+		}
+	}
+}
+
+func TestBuildServiceConfigPercentEncodedAuth(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		password string
+	}{
+		{cmd: "http://:8080?auth=user:p%25zz", password: "p%zz"},
+		{cmd: "http://:8080?auth=user:a%2541", password: "a%41"},
+		{cmd: "http://:8080?auth=user:a%26b", password: "a&b"},
+	}
+	for _, tt := range tests {
+		u, err := normCmd(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc, _, err := buildServiceConfig(u)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		if auth := svc.Handler.Auth; auth == nil || auth.Username != "user" || auth.Password != tt.password {
+			t.Errorf("%s: got auth %+v, want password %s", tt.cmd, auth, tt.password)
+		}
+	}
+}
+
+func TestNormCmdHTTPS(t *testing.T) {
+	u, err := normCmd("https://:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "http+tls" {
+		t.Errorf("got scheme %s, want http+tls", u.Scheme)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("GOST_TEST_USER", "admin")
+	t.Setenv("GOST_TEST_PASS", "p$ss")
+
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "http://$GOST_TEST_USER:${GOST_TEST_PASS}@:8080", want: "http://admin:p$ss@:8080"},
+		{s: "http://:8080?path=/$$GOST_TEST_USER", want: "http://:8080?path=/$GOST_TEST_USER"},
+		{s: "http://:8080?re=^a$", want: "http://:8080?re=^a$"},
+		{s: "http://:8080?re=$1$-$?$@$!$#$*", want: "http://:8080?re=$1$-$?$@$!$#$*"},
+		{s: "http://:8080?re=${1}${}", want: "http://:8080?re=${1}${}"},
+		{s: "http://:8080?v=$GOST_TEST_UNDEFINED", want: "http://:8080?v="},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.s, got, tt.want)
+		}
+	}
+
+	strictEnv = true
+	defer func() { strictEnv = false }()
+	if _, err := expandEnv("http://:8080?v=${GOST_TEST_UNDEFINED}"); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCmd)
+	}
+	for _, s := range []string{"http://$GOST_TEST_USER@:8080", "http://:8080?re=$1$$GOST_TEST_UNDEFINED"} {
+		if _, err := expandEnv(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestBuildConfigFromCmdMultipleAuths(t *testing.T) {
+	cfg, err := buildConfigFromCmd(stringList{"http://u0:p0@:8080?auth=u1:p1,u2:p2&auth=u3:p3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := cfg.Services[0]
+	if svc.Handler.Auth != nil {
+		t.Errorf("got handler auth %+v, want an auther", svc.Handler.Auth)
+	}
+	if _, ok := svc.Handler.Metadata["auth"]; ok {
+		t.Error("auth is left in the handler metadata")
+	}
+	if len(cfg.Authers) != 1 || svc.Handler.Auther != cfg.Authers[0].Name {
+		t.Fatalf("got authers %+v, handler auther %s", cfg.Authers, svc.Handler.Auther)
+	}
+	var users []string
+	for _, auth := range cfg.Authers[0].Auths {
+		users = append(users, auth.Username+":"+auth.Password)
+	}
+	if got, want := strings.Join(users, ","), "u1:p1,u2:p2,u3:p3"; got != want {
+		t.Errorf("got auths %s, want %s", got, want)
+	}
+
+	for _, tt := range []struct {
+		cmd  string
+		user string
+	}{
+		{cmd: "http://u0:p0@:8080", user: "u0"},
+		// a single auth overrides the user info.
+		{cmd: "http://u0:p0@:8080?auth=u1:p1", user: "u1"},
+	} {
+		cfg, err = buildConfigFromCmd(stringList{tt.cmd}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth := cfg.Services[0].Handler.Auth; auth == nil || auth.Username != tt.user || len(cfg.Authers) != 0 {
+			t.Errorf("%s: got handler auth %+v and %d authers, want %s and no auther", tt.cmd, auth, len(cfg.Authers), tt.user)
+		}
+	}
+}
+
+func TestBuildServiceConfigUDPTTL(t *testing.T) {
+	tests := []struct {
+		cmd string
+		ttl any
+	}{
+		{cmd: "udp://:1053/1.1.1.1:53?udp.ttl=5m", ttl: "5m0s"},
+		{cmd: "rudp://:1053/1.1.1.1:53?udp.ttl=30s", ttl: "30s"},
+		{cmd: "dns://:1053?udp.ttl=5m"},
+		{cmd: "dns://:1053?udp.ttl=5m&ttl=1m", ttl: "1m"},
+	}
+	for _, tt := range tests {
+		u, err := normCmd(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc, _, err := buildServiceConfig(u)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		if ttl := svc.Handler.Metadata["ttl"]; ttl != tt.ttl {
+			t.Errorf("%s: got ttl %v, want %v", tt.cmd, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{strategy: "round", want: "round"},
+		{strategy: "rr", want: "rr"},
+		{strategy: "random", want: "random"},
+		{strategy: "rand", want: "rand"},
+		{strategy: "fifo", want: "fifo"},
+		{strategy: "ha", want: "ha"},
+		{strategy: "hash"},
+		{strategy: "leastLatency"},
+		{strategy: "unknown"},
+	}
+	for _, tt := range tests {
+		selector, err := parseSelector(map[string]any{"strategy": tt.strategy})
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidCmd) {
+				t.Errorf("%s: got error %v, want %v", tt.strategy, err, ErrInvalidCmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.strategy, err)
+			continue
+		}
+		if selector.Strategy != tt.want {
+			t.Errorf("got strategy %s, want %s", selector.Strategy, tt.want)
+		}
+	}
+}
+
+func TestAPIConfig(t *testing.T) {
+	t.Setenv("GOST_API_PATHPREFIX", "/api")
+	t.Setenv("GOST_API_ACCESSLOG", "true")
+	t.Setenv("GOST_API_AUTH", base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+
+	cfg, err := apiConfig(":18080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":18080" || cfg.PathPrefix != "/api" || !cfg.AccessLog {
+		t.Errorf("got %+v", cfg)
+	}
+	if cfg.Auth == nil || cfg.Auth.Username != "admin" || cfg.Auth.Password != "secret" {
+		t.Errorf("got auth %+v, want admin:secret", cfg.Auth)
+	}
+
+	t.Setenv("GOST_API_AUTH", "admin:secret")
+	if cfg, err = apiConfig(":18080"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auth == nil || cfg.Auth.Username != "admin" || cfg.Auth.Password != "secret" {
+		t.Errorf("got auth %+v, want admin:secret", cfg.Auth)
+	}
+
+	t.Setenv("GOST_API_ACCESSLOG", "yes")
+	if _, err := apiConfig(":18080"); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCmd)
+	}
+}
+
+func TestBuildConfigFromCmdGOSTConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "base.yaml")
+	base := `services:
+- name: service-0
+  addr: ":9000"
+  bypass: bypass-0
+  handler:
+    type: http
+  listener:
+    type: tcp
+bypasses:
+- name: bypass-0
+  matchers:
+  - internal.example.com
+`
+	if err := os.WriteFile(file, []byte(base), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOST_CONFIG", file)
+
+	cfg, err := buildConfigFromCmd(stringList{"http://:8080?bypass=example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Services) != 2 || len(cfg.Bypasses) != 2 {
+		t.Fatalf("got %d services and %d bypasses, want 2 and 2", len(cfg.Services), len(cfg.Bypasses))
+	}
+	if svc := cfg.Services[0]; svc.Name != "service-0" || svc.Addr != ":9000" || svc.Bypass != "bypass-0" {
+		t.Errorf("base service is modified: %+v", svc)
+	}
+	if bp := cfg.Bypasses[0]; bp.Name != "bypass-0" || bp.Matchers[0] != "internal.example.com" {
+		t.Errorf("base bypass is modified: %+v", bp)
+	}
+	if svc := cfg.Services[1]; svc.Name != "service-1" || svc.Addr != ":8080" || svc.Bypass != "bypass-1" {
+		t.Errorf("got command line service %+v, want service-1 with bypass-1", svc)
+	}
+	if bp := cfg.Bypasses[1]; bp.Name != "bypass-1" || bp.Matchers[0] != "example.com" {
+		t.Errorf("got command line bypass %+v, want bypass-1", bp)
+	}
+}
+
+func TestBuildConfigFromCmdGOSTConfigEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "base.yaml")
+	base := `log:
+  output: /var/log/gost.log
+  format: json
+  level: info
+metrics:
+  addr: ":9000"
+  path: /gost/metrics
+`
+	if err := os.WriteFile(file, []byte(base), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOST_CONFIG", file)
+	t.Setenv("GOST_LOGGER_LEVEL", "debug")
+	t.Setenv("GOST_METRICS", ":9001")
+
+	cfg, err := buildConfigFromCmd(stringList{":8080"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (config.LogConfig{Output: "/var/log/gost.log", Format: "json", Level: "debug"}); *cfg.Log != want {
+		t.Errorf("got log %+v, want %+v", *cfg.Log, want)
+	}
+	if want := (config.MetricsConfig{Addr: ":9001", Path: "/gost/metrics"}); *cfg.Metrics != want {
+		t.Errorf("got metrics %+v, want %+v", *cfg.Metrics, want)
+	}
+}
+
+func TestNameSet(t *testing.T) {
+	names := nameSet{"service-0": true, "service-2": true}
+	for _, want := range []string{"service-1", "service-3", "service-4"} {
+		if got := names.next("service", 0); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestBuildServiceConfigHTTPSEnforce(t *testing.T) {
+	tests := []struct {
+		cmd string
+		ok  bool
+	}{
+		{cmd: "http://:8080?https.enforce=false", ok: true},
+		{cmd: "http://:8080?https.enforce=true&https.hosts=example.com"},
+		{cmd: "http://:8080?https.enforce=yes"},
+	}
+	for _, tt := range tests {
+		u, err := normCmd(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = buildServiceConfig(u)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.cmd, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", tt.cmd, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildConfigFromCmdPortRange(t *testing.T) {
+	cfg, err := buildConfigFromCmd(stringList{"tcp://:20000-20002/backend:80"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Services) != 3 {
+		t.Fatalf("got %d services, want 3", len(cfg.Services))
+	}
+	for i, svc := range cfg.Services {
+		if addr := fmt.Sprintf(":%d", 20000+i); svc.Addr != addr {
+			t.Errorf("service addr: got %s, want %s", svc.Addr, addr)
+		}
+		name := "service-0"
+		if i > 0 {
+			name = fmt.Sprintf("service-0-%d", i)
+		}
+		if svc.Name != name {
+			t.Errorf("service name: got %s, want %s", svc.Name, name)
+		}
+		if svc.Forwarder == nil || len(svc.Forwarder.Nodes) != 1 || svc.Forwarder.Nodes[0].Addr != "backend:80" {
+			t.Errorf("%s: got forwarder %+v, want backend:80", svc.Name, svc.Forwarder)
+		}
+	}
+
+	for _, s := range []string{
+		"tcp://:20010-20000/backend:80",
+		"tcp://:20000-20002,:30000/backend:80",
+		"tcp://:1-65535/backend:80",
+	} {
+		if _, err := buildConfigFromCmd(stringList{s}, nil); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", s, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildConfigFromCmdNodePoolServerName(t *testing.T) {
+	tests := []struct {
+		node string
+		want []string
+	}{
+		{
+			node: "http+tls://a.example.com:443,b.example.com:443?secure=true",
+			want: []string{"a.example.com", "b.example.com"},
+		},
+		{
+			node: "http+tls://a.example.com:443,b.example.com:443?secure=true&serverName=example.com",
+			want: []string{"example.com", "example.com"},
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := buildConfigFromCmd(stringList{":8080"}, stringList{tt.node})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes := cfg.Chains[0].Hops[0].Nodes
+		if len(nodes) != len(tt.want) {
+			t.Fatalf("%s: got %d nodes, want %d", tt.node, len(nodes), len(tt.want))
+		}
+		for i, node := range nodes {
+			if node.Dialer.TLS == nil || node.Dialer.TLS.ServerName != tt.want[i] {
+				t.Errorf("%s: node %s got dialer TLS %+v, want server name %s", tt.node, node.Addr, node.Dialer.TLS, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBuildConfigFromCmdAddrList(t *testing.T) {
+	cfg, err := buildConfigFromCmd(stringList{"tcp://:8080,127.0.0.1:8081/backend:80?foo=bar"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name string
+		addr string
+	}{
+		{name: "service-0", addr: ":8080"},
+		{name: "service-0-1", addr: "127.0.0.1:8081"},
+	}
+	if len(cfg.Services) != len(want) {
+		t.Fatalf("got %d services, want %d", len(cfg.Services), len(want))
+	}
+	for i, svc := range cfg.Services {
+		if svc.Name != want[i].name || svc.Addr != want[i].addr {
+			t.Errorf("got service %s on %s, want %s on %s", svc.Name, svc.Addr, want[i].name, want[i].addr)
+		}
+		if svc.Forwarder == nil || len(svc.Forwarder.Nodes) != 1 || svc.Forwarder.Nodes[0].Addr != "backend:80" {
+			t.Errorf("%s: got forwarder %+v, want backend:80", svc.Name, svc.Forwarder)
+		}
+		if svc.Handler.Type != "tcp" || svc.Listener.Type != "tcp" || svc.Handler.Metadata["foo"] != "bar" {
+			t.Errorf("%s: got handler %+v and listener %+v", svc.Name, svc.Handler, svc.Listener)
+		}
+	}
+	if cfg.Services[0].Handler == cfg.Services[1].Handler || cfg.Services[0].Listener == cfg.Services[1].Listener {
+		t.Error("the services share the handler or listener config")
+	}
+}
+
+func TestRouteMetadata(t *testing.T) {
+	cfg, err := buildConfigFromCmd(
+		stringList{"http://:8080?foo=bar&handler.foo=h&listener.backlog=128&handler.readTimeout=5s"},
+		stringList{"socks5://1.2.3.4:1080?connector.foo=c&dialer.foo=d&bar=baz"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		md     map[string]any
+		want   map[string]any
+	}{
+		{target: "handler", md: cfg.Services[0].Handler.Metadata, want: map[string]any{"foo": "h", "readTimeout": "5s"}},
+		{target: "listener", md: cfg.Services[0].Listener.Metadata, want: map[string]any{"foo": "bar", "backlog": "128"}},
+		{target: "service", md: cfg.Services[0].Metadata, want: map[string]any{"foo": "bar"}},
+		{target: "connector", md: cfg.Chains[0].Hops[0].Nodes[0].Connector.Metadata, want: map[string]any{"foo": "c", "bar": "baz"}},
+		{target: "dialer", md: cfg.Chains[0].Hops[0].Nodes[0].Dialer.Metadata, want: map[string]any{"foo": "d", "bar": "baz"}},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.want {
+			if tt.md[k] != v {
+				t.Errorf("%s: got %s=%v, want %v", tt.target, k, tt.md[k], v)
+			}
+		}
+		for k := range tt.md {
+			for _, prefix := range []string{"handler.", "listener.", "connector.", "dialer."} {
+				if strings.HasPrefix(k, prefix) {
+					t.Errorf("%s: got prefixed key %s", tt.target, k)
+				}
+			}
+		}
+	}
+	if _, ok := cfg.Services[0].Listener.Metadata["readTimeout"]; ok {
+		t.Error("listener: got the handler key readTimeout")
+	}
+	if _, ok := cfg.Services[0].Handler.Metadata["backlog"]; ok {
+		t.Error("handler: got the listener key backlog")
+	}
+}
+
+func TestParseRecorder(t *testing.T) {
+	tests := []struct {
+		s     string
+		file  *config.FileRecorder
+		redis *config.RedisRecorder
+	}{
+		{s: "file:/var/log/gost/clients.log", file: &config.FileRecorder{Path: "/var/log/gost/clients.log"}},
+		{s: "redis://127.0.0.1:6379/gost:clients", redis: &config.RedisRecorder{Addr: "127.0.0.1:6379", Key: "gost:clients"}},
+		{s: "redis://:secret@127.0.0.1:6379", redis: &config.RedisRecorder{Addr: "127.0.0.1:6379", Password: "secret"}},
+	}
+	for _, tt := range tests {
+		cfg, err := parseRecorder(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.s, err)
+			continue
+		}
+		if tt.file != nil && (cfg.File == nil || *cfg.File != *tt.file || cfg.Redis != nil) {
+			t.Errorf("%s: got %+v, want file recorder %+v", tt.s, cfg, tt.file)
+		}
+		if tt.redis != nil && (cfg.Redis == nil || *cfg.Redis != *tt.redis || cfg.File != nil) {
+			t.Errorf("%s: got %+v, want redis recorder %+v", tt.s, cfg, tt.redis)
+		}
+	}
+
+	for _, s := range []string{"file:", "/var/log/gost/clients.log", "redis://", "http://127.0.0.1:6379/key"} {
+		if _, err := parseRecorder(s); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", s, err, ErrInvalidCmd)
+		}
+	}
+
+	cfg, err := buildConfigFromCmd(stringList{"http://:8080?recorder=file:/tmp/a.log,redis://127.0.0.1:6379/key"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := cfg.Services[0]
+	if len(cfg.Recorders) != 2 || len(svc.Recorders) != 2 {
+		t.Fatalf("got %d recorders used by %d service recorders, want 2 and 2", len(cfg.Recorders), len(svc.Recorders))
+	}
+	for i, rec := range svc.Recorders {
+		if rec.Name != cfg.Recorders[i].Name || rec.Record != recorder.RecorderServiceClientAddress {
+			t.Errorf("got service recorder %+v, want %s recording the client address", rec, cfg.Recorders[i].Name)
+		}
+	}
+	if _, ok := svc.Handler.Metadata["recorder"]; ok {
+		t.Error("recorder is left in the metadata")
+	}
+}
+
+func TestBuildServiceConfigUnsupported(t *testing.T) {
+	for _, k := range unsupportedServiceOptions {
+		u, err := normCmd("http://:8080?" + k + "=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := buildServiceConfig(u); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", k, err, ErrInvalidCmd)
+		}
+	}
+}
+
+func TestBuildNodeConfigUnsupported(t *testing.T) {
+	for _, k := range unsupportedNodeOptions {
+		u, err := normCmd("http://1.2.3.4:8080?" + k + "=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := buildNodeConfig(u); !errors.Is(err, ErrInvalidCmd) {
+			t.Errorf("%s: got error %v, want %v", k, err, ErrInvalidCmd)
+		}
+	}
+}
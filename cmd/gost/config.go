@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-gost/core/logger"
 	"github.com/go-gost/core/service"
@@ -12,9 +17,12 @@ import (
 	xlogger "github.com/go-gost/x/logger"
 	metrics "github.com/go-gost/x/metrics/service"
 	"github.com/go-gost/x/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
-func buildService(cfg *config.Config) (services []service.Service) {
+// buildService registers the components and services of cfg.
+func buildService(cfg *config.Config) (services []service.Service, err error) {
 	if cfg == nil {
 		return
 	}
@@ -22,7 +30,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, autherCfg := range cfg.Authers {
 		if auther := parsing.ParseAuther(autherCfg); auther != nil {
 			if err := registry.AutherRegistry().Register(autherCfg.Name, auther); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -30,7 +38,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, admissionCfg := range cfg.Admissions {
 		if adm := parsing.ParseAdmission(admissionCfg); adm != nil {
 			if err := registry.AdmissionRegistry().Register(admissionCfg.Name, adm); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -38,7 +46,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, bypassCfg := range cfg.Bypasses {
 		if bp := parsing.ParseBypass(bypassCfg); bp != nil {
 			if err := registry.BypassRegistry().Register(bypassCfg.Name, bp); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -46,11 +54,11 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, resolverCfg := range cfg.Resolvers {
 		r, err := parsing.ParseResolver(resolverCfg)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		if r != nil {
 			if err := registry.ResolverRegistry().Register(resolverCfg.Name, r); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -58,7 +66,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, hostsCfg := range cfg.Hosts {
 		if h := parsing.ParseHosts(hostsCfg); h != nil {
 			if err := registry.HostsRegistry().Register(hostsCfg.Name, h); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -66,7 +74,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, recorderCfg := range cfg.Recorders {
 		if h := parsing.ParseRecorder(recorderCfg); h != nil {
 			if err := registry.RecorderRegistry().Register(recorderCfg.Name, h); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -74,7 +82,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, rlimiterCfg := range cfg.Limiters {
 		if h := parsing.ParseRateLimiter(rlimiterCfg); h != nil {
 			if err := registry.RateLimiterRegistry().Register(rlimiterCfg.Name, h); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
@@ -82,24 +90,38 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	for _, chainCfg := range cfg.Chains {
 		c, err := parsing.ParseChain(chainCfg)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		if c != nil {
 			if err := registry.ChainRegistry().Register(chainCfg.Name, c); err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
 
+	var registered []string
+	defer func() {
+		// do not leave the services created so far listening,
+		// the running services with the same names are not touched.
+		if err != nil {
+			for _, name := range registered {
+				registry.ServiceRegistry().Unregister(name)
+			}
+			services = nil
+		}
+	}()
+
 	for _, svcCfg := range cfg.Services {
 		svc, err := parsing.ParseService(svcCfg)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("service %s: %w", svcCfg.Name, err)
 		}
 		if svc != nil {
 			if err := registry.ServiceRegistry().Register(svcCfg.Name, svc); err != nil {
-				log.Fatal(err)
+				svc.Close()
+				return nil, fmt.Errorf("service %s: %w", svcCfg.Name, err)
 			}
+			registered = append(registered, svcCfg.Name)
 		}
 		services = append(services, svc)
 	}
@@ -107,6 +129,150 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	return
 }
 
+// loadConfigFiles loads and merges the config files in order,
+// the latter ones override the former ones.
+func loadConfigFiles(files ...string) (*config.Config, error) {
+	cfg := &config.Config{}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		c := &config.Config{}
+		if err := c.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		cfg = mergeConfig(cfg, c)
+	}
+	return cfg, nil
+}
+
+// mergeConfig merges src into dst. The object lists are concatenated,
+// objects in src replace the objects with the same name in dst,
+// other sections in src override the ones in dst if set.
+func mergeConfig(dst, src *config.Config) *config.Config {
+	if dst == nil {
+		return src
+	}
+	if src == nil {
+		return dst
+	}
+
+	cfg := *dst
+	cfg.Services = mergeByName(dst.Services, src.Services, func(c *config.ServiceConfig) string { return c.Name })
+	cfg.Chains = mergeByName(dst.Chains, src.Chains, func(c *config.ChainConfig) string { return c.Name })
+	cfg.Authers = mergeByName(dst.Authers, src.Authers, func(c *config.AutherConfig) string { return c.Name })
+	cfg.Admissions = mergeByName(dst.Admissions, src.Admissions, func(c *config.AdmissionConfig) string { return c.Name })
+	cfg.Bypasses = mergeByName(dst.Bypasses, src.Bypasses, func(c *config.BypassConfig) string { return c.Name })
+	cfg.Resolvers = mergeByName(dst.Resolvers, src.Resolvers, func(c *config.ResolverConfig) string { return c.Name })
+	cfg.Hosts = mergeByName(dst.Hosts, src.Hosts, func(c *config.HostsConfig) string { return c.Name })
+	cfg.Recorders = mergeByName(dst.Recorders, src.Recorders, func(c *config.RecorderConfig) string { return c.Name })
+	cfg.Limiters = mergeByName(dst.Limiters, src.Limiters, func(c *config.LimiterConfig) string { return c.Name })
+	if src.TLS != nil {
+		cfg.TLS = src.TLS
+	}
+	if src.Log != nil {
+		cfg.Log = src.Log
+	}
+	if src.Profiling != nil {
+		cfg.Profiling = src.Profiling
+	}
+	if src.API != nil {
+		cfg.API = src.API
+	}
+	if src.Metrics != nil {
+		cfg.Metrics = src.Metrics
+	}
+	return &cfg
+}
+
+func mergeByName[T any](dst, src []T, name func(T) string) []T {
+	var list []T
+	index := map[string]int{}
+	for _, v := range append(append([]T{}, dst...), src...) {
+		if i, ok := index[name(v)]; ok {
+			list[i] = v
+			continue
+		}
+		index[name(v)] = len(list)
+		list = append(list, v)
+	}
+	return list
+}
+
+// checkChainDepth checks the chains nested by the resolvers of the hops and nodes,
+// whose nameservers can dial through another chain. The nesting depth is limited
+// by GOST_MAX_CHAIN_DEPTH, and the loops are rejected.
+func checkChainDepth(cfg *config.Config) error {
+	v := os.Getenv("GOST_MAX_CHAIN_DEPTH")
+	if v == "" {
+		return nil
+	}
+	max, err := strconv.Atoi(v)
+	if err != nil || max <= 0 {
+		return fmt.Errorf("invalid GOST_MAX_CHAIN_DEPTH %s", v)
+	}
+
+	chains := map[string]*config.ChainConfig{}
+	for _, c := range cfg.Chains {
+		chains[c.Name] = c
+	}
+	resolvers := map[string]*config.ResolverConfig{}
+	for _, r := range cfg.Resolvers {
+		resolvers[r.Name] = r
+	}
+	// nested returns the chains used by the resolvers of the chain.
+	nested := func(c *config.ChainConfig) []string {
+		var refs, names []string
+		for _, hop := range c.Hops {
+			refs = append(refs, hop.Resolver)
+			for _, node := range hop.Nodes {
+				refs = append(refs, node.Resolver)
+			}
+		}
+		for _, ref := range refs {
+			r := resolvers[ref]
+			if r == nil {
+				continue
+			}
+			for _, ns := range r.Nameservers {
+				if ns.Chain != "" {
+					names = append(names, ns.Chain)
+				}
+			}
+		}
+		return names
+	}
+
+	var walk func(name string, path []string) error
+	walk = func(name string, path []string) error {
+		for _, v := range path {
+			if v == name {
+				return fmt.Errorf("chain reference loop %s", strings.Join(append(path, name), " -> "))
+			}
+		}
+		path = append(path, name)
+		if len(path) > max {
+			return fmt.Errorf("chain %s exceeds the max depth %d", path[0], max)
+		}
+		c := chains[name]
+		if c == nil {
+			return nil
+		}
+		for _, v := range nested(c) {
+			if err := walk(v, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range cfg.Chains {
+		if err := walk(c.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func logFromConfig(cfg *config.LogConfig) logger.Logger {
 	if cfg == nil {
 		cfg = &config.LogConfig{}
@@ -116,25 +282,50 @@ func logFromConfig(cfg *config.LogConfig) logger.Logger {
 		xlogger.LevelLoggerOption(logger.LogLevel(cfg.Level)),
 	}
 
-	var out io.Writer = os.Stderr
-	switch cfg.Output {
+	var lg logger.Logger
+	if out := logOutput(cfg.Output); out != nil {
+		opts = append(opts, xlogger.OutputLoggerOption(out))
+		lg = xlogger.NewLogger(opts...)
+	} else {
+		lg = xlogger.Nop()
+	}
+
+	// GOST_ACCESSLOG enables a separate access log in JSON (ndjson) format,
+	// the connection events (info level logs with the remote address) are written to it
+	// in addition to the diagnostic log.
+	if v := os.Getenv("GOST_ACCESSLOG"); v != "" {
+		if out := logOutput(v); out != nil {
+			return &teeLogger{
+				Logger: lg,
+				access: xlogger.NewLogger(
+					xlogger.FormatLoggerOption(logger.JSONFormat),
+					xlogger.LevelLoggerOption(logger.InfoLevel),
+					xlogger.OutputLoggerOption(out),
+				),
+			}
+		}
+	}
+
+	return lg
+}
+
+// logOutput returns the writer for the log output, nil means no output.
+func logOutput(output string) io.Writer {
+	switch output {
 	case "none", "null":
-		return xlogger.Nop()
+		return nil
 	case "stdout":
-		out = os.Stdout
+		return os.Stdout
 	case "stderr", "":
-		out = os.Stderr
+		return os.Stderr
 	default:
-		f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
 			log.Warn(err)
-		} else {
-			out = f
+			return os.Stderr
 		}
+		return f
 	}
-	opts = append(opts, xlogger.OutputLoggerOption(out))
-
-	return xlogger.NewLogger(opts...)
 }
 
 func buildAPIService(cfg *config.APIConfig) (service.Service, error) {
@@ -150,6 +341,71 @@ func buildAPIService(cfg *config.APIConfig) (service.Service, error) {
 	)
 }
 
+type metricsPushConfig struct {
+	URL      string
+	Interval time.Duration
+	Job      string
+	// Instance is the value of the instance grouping label,
+	// so the metrics of several instances pushed with the same job do not replace each other.
+	Instance string
+}
+
+// metricsPushFromEnv reads the Pushgateway settings,
+// pushing is disabled if GOST_METRICS_PUSH is not set.
+func metricsPushFromEnv() (*metricsPushConfig, error) {
+	v := os.Getenv("GOST_METRICS_PUSH")
+	if v == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(v); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid GOST_METRICS_PUSH %s", v)
+	}
+
+	cfg := &metricsPushConfig{
+		URL:      v,
+		Interval: 15 * time.Second,
+		Job:      "gost",
+	}
+	if v := os.Getenv("GOST_METRICS_PUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid GOST_METRICS_PUSH_INTERVAL %s", v)
+		}
+		cfg.Interval = d
+	}
+	if v := os.Getenv("GOST_METRICS_PUSH_JOB"); v != "" {
+		cfg.Job = v
+	}
+	cfg.Instance = os.Getenv("GOST_METRICS_PUSH_INSTANCE")
+	if cfg.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("GOST_METRICS_PUSH_INSTANCE: %v", err)
+		}
+		cfg.Instance = hostname
+	}
+	return cfg, nil
+}
+
+func pushMetrics(cfg *metricsPushConfig) {
+	pusher := newMetricsPusher(cfg, prometheus.DefaultGatherer)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pusher.Push(); err != nil {
+			log.Warn("metrics push: ", err)
+		}
+	}
+}
+
+func newMetricsPusher(cfg *metricsPushConfig, g prometheus.Gatherer) *push.Pusher {
+	return push.New(cfg.URL, cfg.Job).
+		Grouping("instance", cfg.Instance).
+		Gatherer(g)
+}
+
 func buildMetricsService(cfg *config.MetricsConfig) (service.Service, error) {
 	return metrics.NewService(
 		cfg.Addr,
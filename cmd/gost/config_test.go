@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCheckChainDepth(t *testing.T) {
+	// chain-0 resolves through resolver-0, whose nameserver dials through chain-1,
+	// chain-1 resolves through resolver-1, whose nameserver dials through chain.
+	nestedConfig := func(chain string) *config.Config {
+		return &config.Config{
+			Chains: []*config.ChainConfig{
+				{
+					Name: "chain-0",
+					Hops: []*config.HopConfig{{
+						Name:     "hop-0",
+						Resolver: "resolver-0",
+						Nodes:    []*config.NodeConfig{{Name: "node-0", Addr: ":8080"}},
+					}},
+				},
+				{
+					Name: "chain-1",
+					Hops: []*config.HopConfig{{
+						Name: "hop-1",
+						Nodes: []*config.NodeConfig{{
+							Name:     "node-1",
+							Addr:     ":8081",
+							Resolver: "resolver-1",
+						}},
+					}},
+				},
+				{
+					Name: "chain-2",
+					Hops: []*config.HopConfig{{
+						Name:  "hop-2",
+						Nodes: []*config.NodeConfig{{Name: "node-2", Addr: ":8082"}},
+					}},
+				},
+			},
+			Resolvers: []*config.ResolverConfig{
+				{
+					Name:        "resolver-0",
+					Nameservers: []*config.NameserverConfig{{Addr: "udp://8.8.8.8:53", Chain: "chain-1"}},
+				},
+				{
+					Name:        "resolver-1",
+					Nameservers: []*config.NameserverConfig{{Addr: "udp://1.1.1.1:53", Chain: chain}},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		depth string
+		chain string
+		ok    bool
+	}{
+		{depth: "", chain: "chain-0", ok: true},
+		{depth: "3", chain: "chain-2", ok: true},
+		{depth: "2", chain: "chain-2"},
+		{depth: "10", chain: "chain-0"},
+		{depth: "10", chain: "chain-1"},
+		{depth: "0", chain: "chain-2"},
+		{depth: "x", chain: "chain-2"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GOST_MAX_CHAIN_DEPTH", tt.depth)
+		err := checkChainDepth(nestedConfig(tt.chain))
+		if tt.ok && err != nil {
+			t.Errorf("depth %s, chain %s: unexpected error %v", tt.depth, tt.chain, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("depth %s, chain %s: expected an error", tt.depth, tt.chain)
+		}
+	}
+}
+
+func TestBuildConfigFromCmdChainDepth(t *testing.T) {
+	t.Setenv("GOST_MAX_CHAIN_DEPTH", "1")
+	if _, err := buildConfigFromCmd(stringList{":8080"}, stringList{"1.2.3.4:8080", "5.6.7.8:8080"}); err != nil {
+		t.Errorf("the hops of a chain are not nested: %v", err)
+	}
+
+	t.Setenv("GOST_MAX_CHAIN_DEPTH", "-1")
+	if _, err := buildConfigFromCmd(stringList{":8080"}, nil); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCmd)
+	}
+}
+
+func TestMetricsPushFromEnv(t *testing.T) {
+	t.Setenv("GOST_METRICS_PUSH", "")
+	t.Setenv("GOST_METRICS_PUSH_INTERVAL", "1m")
+	if cfg, err := metricsPushFromEnv(); err != nil || cfg != nil {
+		t.Fatalf("got %+v, %v, want pushing disabled", cfg, err)
+	}
+
+	t.Setenv("GOST_METRICS_PUSH", "http://127.0.0.1:9091")
+	t.Setenv("GOST_METRICS_PUSH_JOB", "edge")
+	t.Setenv("GOST_METRICS_PUSH_INSTANCE", "edge-1")
+	cfg, err := metricsPushFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "http://127.0.0.1:9091" || cfg.Interval != time.Minute || cfg.Job != "edge" || cfg.Instance != "edge-1" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	t.Setenv("GOST_METRICS_PUSH_INTERVAL", "")
+	t.Setenv("GOST_METRICS_PUSH_JOB", "")
+	t.Setenv("GOST_METRICS_PUSH_INSTANCE", "")
+	if cfg, err = metricsPushFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if cfg.Interval != 15*time.Second || cfg.Job != "gost" || cfg.Instance != hostname {
+		t.Errorf("got %+v, want the default interval, job and instance", cfg)
+	}
+
+	for _, tt := range []struct {
+		url      string
+		interval string
+	}{
+		{url: "127.0.0.1:9091"},
+		{url: "ftp://127.0.0.1:9091"},
+		{url: "http://"},
+		{url: "http://127.0.0.1:9091", interval: "0s"},
+		{url: "http://127.0.0.1:9091", interval: "1"},
+	} {
+		t.Setenv("GOST_METRICS_PUSH", tt.url)
+		t.Setenv("GOST_METRICS_PUSH_INTERVAL", tt.interval)
+		if _, err := metricsPushFromEnv(); err == nil {
+			t.Errorf("%s every %s: expected an error", tt.url, tt.interval)
+		}
+	}
+}
+
+func TestMetricsPusherGrouping(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer srv.Close()
+
+	cfg := &metricsPushConfig{URL: srv.URL, Job: "gost", Instance: "edge-1"}
+	if err := newMetricsPusher(cfg, prometheus.NewRegistry()).Push(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/metrics/job/gost/instance/edge-1"; path != want {
+		t.Errorf("got path %s, want %s", path, want)
+	}
+}
+
+func TestBuildServiceDuplicate(t *testing.T) {
+	cfg := &config.Config{
+		Authers: []*config.AutherConfig{
+			{Name: "auther-dup", Auths: []*config.AuthConfig{{Username: "a", Password: "1"}}},
+			{Name: "auther-dup", Auths: []*config.AuthConfig{{Username: "b", Password: "2"}}},
+		},
+	}
+	defer registry.AutherRegistry().Unregister("auther-dup")
+	if _, err := buildService(cfg); !errors.Is(err, registry.ErrDup) {
+		t.Errorf("got error %v, want %v", err, registry.ErrDup)
+	}
+}
+
+func TestBuildServiceError(t *testing.T) {
+	running := &testService{}
+	if err := registry.ServiceRegistry().Register("service-running", running); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.ServiceRegistry().Unregister("service-running")
+
+	tests := []struct {
+		name string
+		svc  *config.ServiceConfig
+		err  error
+	}{
+		{
+			name: "certificate",
+			svc: &config.ServiceConfig{
+				Name: "service-bad",
+				Addr: "127.0.0.1:0",
+				Listener: &config.ListenerConfig{
+					Type: "tls",
+					TLS:  &config.TLSConfig{CertFile: "/nonexistent.pem", KeyFile: "/nonexistent.key"},
+				},
+			},
+			err: os.ErrNotExist,
+		},
+		{
+			name: "duplicate",
+			svc:  &config.ServiceConfig{Name: "service-running", Addr: "127.0.0.1:0"},
+			err:  registry.ErrDup,
+		},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{
+			Services: []*config.ServiceConfig{
+				{Name: "service-ok", Addr: "127.0.0.1:0"},
+				tt.svc,
+			},
+		}
+		svcs, err := buildService(cfg)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if svcs != nil {
+			t.Errorf("%s: got %d services, want none", tt.name, len(svcs))
+		}
+		if registry.ServiceRegistry().Get("service-ok") != nil {
+			t.Errorf("%s: the services started before the error are left running", tt.name)
+			registry.ServiceRegistry().Unregister("service-ok")
+		}
+		if registry.ServiceRegistry().Get("service-running") != running || running.closed {
+			t.Errorf("%s: the running service is closed", tt.name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/go-gost/core/logger"
+)
+
+// teeLogger writes the connection events to the access logger as well.
+// The connection events are the info level logs of the loggers with the remote address field,
+// which the handlers create for each connection, the other logs only go to the diagnostic log.
+type teeLogger struct {
+	logger.Logger
+	access logger.Logger
+	conn   bool
+}
+
+func (l *teeLogger) WithFields(fields map[string]any) logger.Logger {
+	_, remote := fields["remote"]
+	return &teeLogger{
+		Logger: l.Logger.WithFields(fields),
+		access: l.access.WithFields(fields),
+		conn:   l.conn || remote,
+	}
+}
+
+func (l *teeLogger) Info(args ...any) {
+	l.Logger.Info(args...)
+	if l.conn {
+		l.access.Info(args...)
+	}
+}
+
+func (l *teeLogger) Infof(format string, args ...any) {
+	l.Logger.Infof(format, args...)
+	if l.conn {
+		l.access.Infof(format, args...)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-gost/x/config"
+)
+
+func TestLogFromConfigAccessLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("GOST_ACCESSLOG", file)
+
+	lg := logFromConfig(&config.LogConfig{Output: "none", Level: "debug"})
+	if _, ok := lg.(*teeLogger); !ok {
+		t.Fatalf("got logger %T, want the access log", lg)
+	}
+
+	svcLog := lg.WithFields(map[string]any{"kind": "service", "service": "service-0"})
+	svcLog.Info("listening on :8080")
+	connLog := svcLog.WithFields(map[string]any{"remote": "1.2.3.4:5678", "local": "127.0.0.1:8080"})
+	connLog.Infof("%s <> %s", "1.2.3.4:5678", "127.0.0.1:8080")
+	connLog.Debug("request")
+	connLog.WithFields(map[string]any{"duration": "1s"}).Info("1.2.3.4:5678 >< 127.0.0.1:8080")
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var msgs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON line %s: %v", scanner.Text(), err)
+		}
+		if entry["service"] != "service-0" || entry["remote"] != "1.2.3.4:5678" {
+			t.Errorf("missing fields in %s", scanner.Text())
+		}
+		msgs = append(msgs, entry["msg"].(string))
+	}
+	want := []string{"1.2.3.4:5678 <> 127.0.0.1:8080", "1.2.3.4:5678 >< 127.0.0.1:8080"}
+	if len(msgs) != len(want) || msgs[0] != want[0] || msgs[1] != want[1] {
+		t.Errorf("got access log %q, want %q", msgs, want)
+	}
+}
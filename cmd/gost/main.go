@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/go-gost/core/logger"
 	"github.com/go-gost/core/metrics"
@@ -14,11 +19,13 @@ import (
 	"github.com/go-gost/x/config/parsing"
 	xlogger "github.com/go-gost/x/logger"
 	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/spf13/viper"
 )
 
 var (
 	log logger.Logger
 
+	printVersion bool
 	cfgFile      string
 	outputFormat string
 	services     stringList
@@ -26,38 +33,41 @@ var (
 	debug        bool
 	apiAddr      string
 	metricsAddr  string
+	strictEnv    bool
+	testConfig   bool
 )
 
 func init() {
-	var printVersion bool
-
 	flag.Var(&services, "L", "service list")
 	flag.Var(&nodes, "F", "chain node list")
 	flag.StringVar(&cfgFile, "C", "", "configure file")
 	flag.BoolVar(&printVersion, "V", false, "print version")
+	flag.BoolVar(&testConfig, "t", false, "test configuration and exit")
 	flag.StringVar(&outputFormat, "O", "", "output format, one of yaml|json format")
 	flag.BoolVar(&debug, "D", false, "debug mode")
 	flag.StringVar(&apiAddr, "api", "", "api service address")
 	flag.StringVar(&metricsAddr, "metrics", "", "metrics service address")
+	flag.BoolVar(&strictEnv, "strict-env", false, "fail on undefined environment variables in -L/-F")
+
+	log = xlogger.NewLogger()
+	logger.SetDefault(log)
+}
+
+func main() {
 	flag.Parse()
 
 	if printVersion {
 		fmt.Fprintf(os.Stdout, "gost %s (%s %s/%s)\n",
 			version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-		os.Exit(0)
+		exit(0)
 	}
 
-	log = xlogger.NewLogger()
-	logger.SetDefault(log)
-}
-
-func main() {
 	cfg := &config.Config{}
 	var err error
 	if len(services) > 0 || apiAddr != "" {
 		cfg, err = buildConfigFromCmd(services, nodes)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		if debug && cfg != nil {
 			if cfg.Log == nil {
@@ -66,8 +76,9 @@ func main() {
 			cfg.Log.Level = string(logger.DebugLevel)
 		}
 		if apiAddr != "" {
-			cfg.API = &config.APIConfig{
-				Addr: apiAddr,
+			cfg.API, err = apiConfig(apiAddr)
+			if err != nil {
+				fatal(err)
 			}
 		}
 		if metricsAddr != "" {
@@ -80,21 +91,47 @@ func main() {
 			err = cfg.ReadFile(cfgFile)
 		} else {
 			err = cfg.Load()
+			// the config files listed in GOST_CONFIG can be used without a default config file.
+			var notFound viper.ConfigFileNotFoundError
+			if errors.As(err, &notFound) && os.Getenv("GOST_CONFIG") != "" {
+				err = nil
+			}
 		}
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
+		}
+		// the config files listed in GOST_CONFIG are the base of the config file,
+		// the objects of the config file win over the ones with the same name.
+		if v := os.Getenv("GOST_CONFIG"); v != "" {
+			base, err := loadConfigFiles(filepath.SplitList(v)...)
+			if err != nil {
+				fatal(err)
+			}
+			cfg = mergeConfig(base, cfg)
+		}
+		if err := checkChainDepth(cfg); err != nil {
+			fatal(err)
 		}
 	}
 
+	if testConfig {
+		if err := validateConfig(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		fmt.Fprintln(os.Stdout, "configuration OK")
+		exit(0)
+	}
+
 	log = logFromConfig(cfg.Log)
 
 	logger.SetDefault(log)
 
 	if outputFormat != "" {
 		if err := cfg.Write(os.Stdout, outputFormat); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		os.Exit(0)
+		exit(0)
 	}
 
 	if cfg.Profiling != nil {
@@ -104,50 +141,88 @@ func main() {
 				addr = ":6060"
 			}
 			log.Info("profiling server on ", addr)
-			log.Fatal(http.ListenAndServe(addr, nil))
+			fatal(http.ListenAndServe(addr, nil))
 		}()
 	}
 
 	if cfg.API != nil {
 		s, err := buildAPIService(cfg.API)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		defer s.Close()
 
 		go func() {
 			log.Info("api service on ", s.Addr())
-			log.Fatal(s.Serve())
+			fatal(s.Serve())
 		}()
 	}
 
-	if cfg.Metrics != nil {
+	pushCfg, err := metricsPushFromEnv()
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Metrics != nil || pushCfg != nil {
 		metrics.Init(xmetrics.NewMetrics())
-		if cfg.Metrics.Addr != "" {
+		if pushCfg != nil {
+			log.Infof("metrics push to %s every %s", pushCfg.URL, pushCfg.Interval)
+			go pushMetrics(pushCfg)
+		}
+		if cfg.Metrics != nil && cfg.Metrics.Addr != "" {
 			s, err := buildMetricsService(cfg.Metrics)
 			if err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
 			go func() {
 				defer s.Close()
 				log.Info("metrics service on ", s.Addr())
-				log.Fatal(s.Serve())
+				fatal(s.Serve())
 			}()
 		}
 	}
 
 	parsing.BuildDefaultTLSConfig(cfg.TLS)
 
-	services := buildService(cfg)
-	for _, svc := range services {
-		svc := svc
-		go func() {
-			svc.Serve()
-			svc.Close()
-		}()
+	svcs, err := buildService(cfg)
+	if err != nil {
+		fatal(err)
 	}
+	serveServices(svcs)
 
 	config.SetGlobal(cfg)
 
-	select {}
+	go watchTLSFiles(10 * time.Second)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			exit(0)
+		}
+		// only the config built from the command line can be reloaded.
+		if len(services) == 0 {
+			continue
+		}
+
+		log.Info("reloading config")
+		c, err := reloadFromCmd(cfg)
+		if err != nil {
+			log.Error("reload: ", err)
+			continue
+		}
+		cfg = c
+		config.SetGlobal(cfg)
+	}
+}
+
+// exit removes the PEM files written for the command line before exiting,
+// they may hold the private keys.
+func exit(code int) {
+	removePEMFiles()
+	os.Exit(code)
+}
+
+func fatal(args ...any) {
+	removePEMFiles()
+	log.Fatal(args...)
 }
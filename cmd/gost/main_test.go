@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExitRemovesPEMFiles(t *testing.T) {
+	if args := os.Getenv("GOST_TEST_MAIN"); args != "" {
+		os.Args = append([]string{"gost"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")})
+	svc := "-L tls://127.0.0.1:0?cert=env:GOST_TEST_CERT&key=env:GOST_TEST_CERT"
+	tests := []struct {
+		args string
+		env  string
+	}{
+		{args: "-t " + svc},
+		{args: "-O yaml " + svc},
+		{args: "-api :0 " + svc, env: "GOST_API_ACCESSLOG=yes"},
+		{args: svc + " -F unknown://:0"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExitRemovesPEMFiles$")
+		cmd.Env = append(os.Environ(),
+			"GOST_TEST_MAIN="+tt.args,
+			"GOST_TEST_CERT="+string(data),
+			"TMPDIR="+dir,
+			tt.env,
+		)
+		cmd.Run()
+
+		files, err := filepath.Glob(filepath.Join(dir, "gost-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) > 0 {
+			t.Errorf("%s: PEM files are left in %s", tt.args, files)
+		}
+	}
+}
+
+func TestConfigFileOverGOSTConfig(t *testing.T) {
+	if args := os.Getenv("GOST_TEST_MAIN"); args != "" {
+		os.Args = append([]string{"gost"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	if err := os.WriteFile(base, []byte("services:\n- name: service-0\n  addr: \":9000\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "gost.yaml")
+	if err := os.WriteFile(file, []byte("services:\n- name: service-0\n  addr: \":8080\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestConfigFileOverGOSTConfig$")
+	cmd.Env = append(os.Environ(),
+		"GOST_TEST_MAIN=-C "+file+" -O json",
+		"GOST_CONFIG="+base,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `":8080"`) || strings.Contains(string(out), `":9000"`) {
+		t.Errorf("the config file is overridden by GOST_CONFIG: %s", out)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-gost/core/service"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+// reloadFromCmd rebuilds the config from the command line and applies it to the running services.
+// Unchanged services keep their listeners open, new services are started first,
+// then the changed services are restarted and services no longer present are closed.
+// If any service fails to start, the running services are left as they were.
+func reloadFromCmd(old *config.Config) (*config.Config, error) {
+	cfg, err := buildConfigFromCmd(services, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	// the log, profiling, API and metrics settings are not reloadable.
+	cfg.Log = old.Log
+	cfg.Profiling = old.Profiling
+	cfg.API = old.API
+	cfg.Metrics = old.Metrics
+
+	// the running components are never unregistered before the new ones are in place,
+	// the changed components are registered under new names and the services refer to them.
+	added, stale := renameComponents(old, cfg)
+
+	running := map[string]*config.ServiceConfig{}
+	for _, svcCfg := range old.Services {
+		running[svcCfg.Name] = svcCfg
+	}
+
+	var addedSvcs, changed, stopped []*config.ServiceConfig
+	for i, svcCfg := range cfg.Services {
+		oldCfg, ok := running[svcCfg.Name]
+		if !ok {
+			addedSvcs = append(addedSvcs, svcCfg)
+			continue
+		}
+		delete(running, svcCfg.Name)
+		if serviceConfigEqual(oldCfg, svcCfg) {
+			// keep the running config, it may have been modified while parsing.
+			cfg.Services[i] = oldCfg
+			continue
+		}
+		changed = append(changed, svcCfg)
+		stopped = append(stopped, oldCfg)
+	}
+	for _, oldCfg := range old.Services {
+		if _, ok := running[oldCfg.Name]; ok {
+			stopped = append(stopped, oldCfg)
+		}
+	}
+
+	if _, err := buildService(componentConfig(added)); err != nil {
+		unregisterComponents(added)
+		return nil, err
+	}
+
+	// the new services do not replace any running one, so they can be started first.
+	started, err := buildService(&config.Config{Services: addedSvcs})
+	if err != nil {
+		unregisterComponents(added)
+		return nil, err
+	}
+
+	// the changed services may listen on the same addresses as the old ones,
+	// so the old ones have to be stopped before starting the new ones.
+	for _, svcCfg := range stopped {
+		registry.ServiceRegistry().Unregister(svcCfg.Name)
+	}
+	restarted, err := buildService(&config.Config{Services: changed})
+	if err != nil {
+		for _, svcCfg := range addedSvcs {
+			registry.ServiceRegistry().Unregister(svcCfg.Name)
+		}
+		unregisterComponents(added)
+		svcs, rerr := buildService(&config.Config{Services: stopped})
+		if rerr != nil {
+			log.Error("reload: restore: ", rerr)
+		}
+		serveServices(svcs)
+		return nil, err
+	}
+	unregisterComponents(stale)
+
+	for _, svcCfg := range addedSvcs {
+		log.Infof("reload: start service %s", svcCfg.Name)
+	}
+	for _, svcCfg := range changed {
+		log.Infof("reload: restart service %s", svcCfg.Name)
+	}
+	for name := range running {
+		log.Infof("reload: stop service %s", name)
+	}
+	serveServices(started)
+	serveServices(restarted)
+
+	return cfg, nil
+}
+
+func serveServices(svcs []service.Service) {
+	for _, svc := range svcs {
+		svc := svc
+		go func() {
+			svc.Serve()
+			svc.Close()
+		}()
+	}
+}
+
+func serviceConfigEqual(a, b *config.ServiceConfig) bool {
+	ba, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ba, bb)
+}
+
+// component is a named object of the config referred to by the services and other components.
+type component struct {
+	kind string
+	name *string
+	cfg  any
+}
+
+func components(cfg *config.Config) (cs []component) {
+	for _, c := range cfg.Authers {
+		cs = append(cs, component{"auther", &c.Name, c})
+	}
+	for _, c := range cfg.Admissions {
+		cs = append(cs, component{"admission", &c.Name, c})
+	}
+	for _, c := range cfg.Bypasses {
+		cs = append(cs, component{"bypass", &c.Name, c})
+	}
+	for _, c := range cfg.Resolvers {
+		cs = append(cs, component{"resolver", &c.Name, c})
+	}
+	for _, c := range cfg.Hosts {
+		cs = append(cs, component{"hosts", &c.Name, c})
+	}
+	for _, c := range cfg.Recorders {
+		cs = append(cs, component{"recorder", &c.Name, c})
+	}
+	for _, c := range cfg.Limiters {
+		cs = append(cs, component{"limiter", &c.Name, c})
+	}
+	for _, c := range cfg.Chains {
+		cs = append(cs, component{"chain", &c.Name, c})
+	}
+	return
+}
+
+// key returns the content of the component regardless of its name.
+func (c component) key() string {
+	name := *c.name
+	*c.name = ""
+	defer func() { *c.name = name }()
+
+	b, _ := json.Marshal(c.cfg)
+	return string(b)
+}
+
+// forEachRef calls fn for each reference to a component in cfg.
+func forEachRef(cfg *config.Config, fn func(kind string, ref *string)) {
+	list := func(kind string, refs []string) {
+		for i := range refs {
+			fn(kind, &refs[i])
+		}
+	}
+	node := func(node *config.NodeConfig) {
+		fn("bypass", &node.Bypass)
+		list("bypass", node.Bypasses)
+		fn("resolver", &node.Resolver)
+		fn("hosts", &node.Hosts)
+	}
+
+	for _, c := range cfg.Resolvers {
+		for _, ns := range c.Nameservers {
+			fn("chain", &ns.Chain)
+		}
+	}
+	for _, c := range cfg.Chains {
+		for _, hop := range c.Hops {
+			fn("bypass", &hop.Bypass)
+			list("bypass", hop.Bypasses)
+			fn("resolver", &hop.Resolver)
+			fn("hosts", &hop.Hosts)
+			for _, n := range hop.Nodes {
+				node(n)
+			}
+		}
+	}
+	for _, svc := range cfg.Services {
+		fn("admission", &svc.Admission)
+		list("admission", svc.Admissions)
+		fn("bypass", &svc.Bypass)
+		list("bypass", svc.Bypasses)
+		fn("resolver", &svc.Resolver)
+		fn("hosts", &svc.Hosts)
+		fn("limiter", &svc.Limiter)
+		for _, rec := range svc.Recorders {
+			fn("recorder", &rec.Name)
+		}
+		if h := svc.Handler; h != nil {
+			fn("chain", &h.Chain)
+			if h.ChainGroup != nil {
+				list("chain", h.ChainGroup.Chains)
+			}
+			fn("auther", &h.Auther)
+			list("auther", h.Authers)
+		}
+		if ln := svc.Listener; ln != nil {
+			fn("chain", &ln.Chain)
+			if ln.ChainGroup != nil {
+				list("chain", ln.ChainGroup.Chains)
+			}
+			fn("auther", &ln.Auther)
+			list("auther", ln.Authers)
+		}
+		if svc.Forwarder != nil {
+			for _, n := range svc.Forwarder.Nodes {
+				node(n)
+			}
+		}
+	}
+}
+
+func rename(cfg *config.Config, c component, name string) {
+	forEachRef(cfg, func(kind string, ref *string) {
+		if kind == c.kind && *ref == *c.name {
+			*ref = name
+		}
+	})
+	*c.name = name
+}
+
+// renameComponents gives each component of cfg the name of the identical running component in old.
+// The new or changed components get a name not in use, and are returned in added
+// to be registered alongside the running ones. The references in cfg are updated accordingly.
+// The running components not used by cfg are returned in stale.
+func renameComponents(old, cfg *config.Config) (added, stale []component) {
+	running := map[string]map[string]string{}
+	for _, c := range components(old) {
+		if running[c.kind] == nil {
+			running[c.kind] = map[string]string{}
+		}
+		running[c.kind][c.key()] = *c.name
+	}
+
+	// a component can only be compared once the components it refers to are named,
+	// so every name is replaced by a placeholder first.
+	const placeholder = "\x00"
+	cs := components(cfg)
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = *c.name
+		rename(cfg, c, fmt.Sprintf("%s%d", placeholder, i))
+	}
+
+	inUse := configNames(old)
+	used := map[string]map[string]bool{}
+	assign := func(i int, reuse bool) {
+		c := cs[i]
+		if used[c.kind] == nil {
+			used[c.kind] = map[string]bool{}
+		}
+		name, ok := running[c.kind][c.key()]
+		if !reuse || !ok || used[c.kind][name] {
+			name = names[i]
+			if inUse[name] {
+				name = inUse.next(name, 1)
+			}
+			inUse[name] = true
+			added = append(added, c)
+		}
+		used[c.kind][name] = true
+		rename(cfg, c, name)
+	}
+
+	pending := make([]int, len(cs))
+	for i := range cs {
+		pending[i] = i
+	}
+	for len(pending) > 0 {
+		var next []int
+		for _, i := range pending {
+			// json escapes the placeholder.
+			if strings.Contains(cs[i].key(), `\u0000`) {
+				next = append(next, i)
+				continue
+			}
+			assign(i, true)
+		}
+		if len(next) == len(pending) {
+			// the components referring to each other can not be compared.
+			for _, i := range next {
+				assign(i, false)
+			}
+			break
+		}
+		pending = next
+	}
+
+	for _, c := range components(old) {
+		if !used[c.kind][*c.name] {
+			stale = append(stale, c)
+		}
+	}
+	return
+}
+
+// componentConfig returns the config with the components cs.
+func componentConfig(cs []component) *config.Config {
+	cfg := &config.Config{}
+	for _, c := range cs {
+		switch v := c.cfg.(type) {
+		case *config.AutherConfig:
+			cfg.Authers = append(cfg.Authers, v)
+		case *config.AdmissionConfig:
+			cfg.Admissions = append(cfg.Admissions, v)
+		case *config.BypassConfig:
+			cfg.Bypasses = append(cfg.Bypasses, v)
+		case *config.ResolverConfig:
+			cfg.Resolvers = append(cfg.Resolvers, v)
+		case *config.HostsConfig:
+			cfg.Hosts = append(cfg.Hosts, v)
+		case *config.RecorderConfig:
+			cfg.Recorders = append(cfg.Recorders, v)
+		case *config.LimiterConfig:
+			cfg.Limiters = append(cfg.Limiters, v)
+		case *config.ChainConfig:
+			cfg.Chains = append(cfg.Chains, v)
+		}
+	}
+	return cfg
+}
+
+func unregisterComponents(cs []component) {
+	for _, c := range cs {
+		switch c.kind {
+		case "auther":
+			registry.AutherRegistry().Unregister(*c.name)
+		case "admission":
+			registry.AdmissionRegistry().Unregister(*c.name)
+		case "bypass":
+			registry.BypassRegistry().Unregister(*c.name)
+		case "resolver":
+			registry.ResolverRegistry().Unregister(*c.name)
+		case "hosts":
+			registry.HostsRegistry().Unregister(*c.name)
+		case "recorder":
+			registry.RecorderRegistry().Unregister(*c.name)
+		case "limiter":
+			registry.RateLimiterRegistry().Unregister(*c.name)
+		case "chain":
+			registry.ChainRegistry().Unregister(*c.name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func listening(addr string) bool {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestReloadFromCmd(t *testing.T) {
+	defer func(s, n stringList) { services, nodes = s, n }(services, nodes)
+	defer registry.ServiceRegistry().Unregister("service-0")
+
+	addr := freeAddr(t)
+	services = stringList{fmt.Sprintf("tcp://%s/127.0.0.1:1", addr)}
+	nodes = nil
+	cfg, err := buildConfigFromCmd(services, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcs, err := buildService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveServices(svcs)
+
+	// the new address is in use, the running service must be kept.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	services = stringList{fmt.Sprintf("tcp://%s/127.0.0.1:1", busy.Addr())}
+	if _, err := reloadFromCmd(cfg); err == nil {
+		t.Fatal("reload to a busy address should fail")
+	}
+	if !listening(addr) {
+		t.Fatalf("service on %s is down after the failed reload", addr)
+	}
+
+	newAddr := freeAddr(t)
+	services = stringList{fmt.Sprintf("tcp://%s/127.0.0.1:1", newAddr)}
+	c, err := reloadFromCmd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Services[0].Addr != newAddr {
+		t.Errorf("service addr: got %s, want %s", c.Services[0].Addr, newAddr)
+	}
+	if !listening(newAddr) {
+		t.Errorf("service on %s is not started", newAddr)
+	}
+	if listening(addr) {
+		t.Errorf("service on %s is not stopped", addr)
+	}
+}
+
+func TestReloadFromCmdComponents(t *testing.T) {
+	defer func(s, n stringList) { services, nodes = s, n }(services, nodes)
+	defer registry.ServiceRegistry().Unregister("service-0")
+
+	addr := freeAddr(t)
+	services = stringList{fmt.Sprintf("http://%s?auth=a:1,b:2", addr)}
+	nodes = nil
+	cfg, err := buildConfigFromCmd(services, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcs, err := buildService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { unregisterComponents(components(cfg)) }()
+	serveServices(svcs)
+
+	reload := func(auth string) {
+		services = stringList{fmt.Sprintf("http://%s?auth=%s", addr, auth)}
+		c, err := reloadFromCmd(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = c
+	}
+
+	running := cfg.Services[0]
+	reload("a:1,b:2")
+	if cfg.Services[0] != running || cfg.Authers[0].Name != "auther-0" {
+		t.Errorf("unchanged service is restarted with auther %s", cfg.Services[0].Handler.Auther)
+	}
+
+	reload("a:1,c:3")
+	if name := cfg.Services[0].Handler.Auther; name != "auther-0-1" || cfg.Authers[0].Name != name {
+		t.Fatalf("got auther %s, want auther-0-1", name)
+	}
+	if registry.AutherRegistry().IsRegistered("auther-0") {
+		t.Error("the old auther is still registered")
+	}
+	if !registry.AutherRegistry().Get("auther-0-1").Authenticate("c", "3") {
+		t.Error("the new auther rejects c:3")
+	}
+
+	reload("a:1,c:3")
+	if name := cfg.Services[0].Handler.Auther; name != "auther-0-1" {
+		t.Errorf("got auther %s, want the running auther-0-1", name)
+	}
+	if !listening(addr) {
+		t.Errorf("service on %s is down", addr)
+	}
+}
+
+func TestRenameComponents(t *testing.T) {
+	newConfig := func(bypass string) *config.Config {
+		return &config.Config{
+			Bypasses: []*config.BypassConfig{{Name: "bypass-0", Matchers: []string{bypass}}},
+			Chains: []*config.ChainConfig{{
+				Name: "chain-0",
+				Hops: []*config.HopConfig{{
+					Name:   "hop-0",
+					Bypass: "bypass-0",
+					Nodes:  []*config.NodeConfig{{Name: "node-0", Addr: ":8080"}},
+				}},
+			}},
+			Services: []*config.ServiceConfig{{
+				Name:    "service-0",
+				Bypass:  "bypass-0",
+				Handler: &config.HandlerConfig{Type: "http", Chain: "chain-0"},
+			}},
+		}
+	}
+
+	old := newConfig("example.com")
+	cfg := newConfig("example.com")
+	added, stale := renameComponents(old, cfg)
+	if len(added) != 0 || len(stale) != 0 {
+		t.Errorf("unchanged config: got %d added and %d stale components", len(added), len(stale))
+	}
+
+	// the chain refers to the changed bypass, so it is changed as well.
+	cfg = newConfig("example.org")
+	added, stale = renameComponents(old, cfg)
+	if len(added) != 2 || len(stale) != 2 {
+		t.Fatalf("got %d added and %d stale components, want 2 and 2", len(added), len(stale))
+	}
+	svc := cfg.Services[0]
+	if svc.Bypass != "bypass-0-1" || svc.Handler.Chain != "chain-0-1" ||
+		cfg.Chains[0].Hops[0].Bypass != "bypass-0-1" {
+		t.Errorf("got service bypass %s and chain %s, hop bypass %s",
+			svc.Bypass, svc.Handler.Chain, cfg.Chains[0].Hops[0].Bypass)
+	}
+	if old.Bypasses[0].Name != "bypass-0" || old.Chains[0].Name != "chain-0" {
+		t.Error("the running config is modified")
+	}
+}
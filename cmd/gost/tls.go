@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/config/parsing"
+	mdx "github.com/go-gost/x/metadata"
+	"github.com/go-gost/x/registry"
+)
+
+// watchTLSFiles polls the certificate files of the services with tls.watch=true in the global config,
+// and restarts the service to reload the TLS config when any of the files is modified.
+func watchTLSFiles(period time.Duration) {
+	w := &tlsWatcher{
+		config:  config.Global,
+		modTime: fileModTime,
+		reload:  reloadService,
+		mtimes:  map[string]time.Time{},
+	}
+	w.check()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.check()
+	}
+}
+
+type tlsWatcher struct {
+	config  func() *config.Config
+	modTime func(file string) (time.Time, error)
+	reload  func(cfg *config.ServiceConfig) error
+	// the modification time of the files at the last successful reload, keyed by service name and file.
+	mtimes map[string]time.Time
+}
+
+// check reloads the services whose certificate files are modified since the last reload,
+// the files of the services seen for the first time are only recorded.
+// A failed reload keeps the running service and is retried on the next check.
+func (w *tlsWatcher) check() {
+	for _, svcCfg := range w.config().Services {
+		if svcCfg.Listener == nil || svcCfg.Listener.TLS == nil ||
+			!mdutil.GetBool(mdx.NewMetadata(svcCfg.Listener.Metadata), "tls.watch") {
+			continue
+		}
+		modified := map[string]time.Time{}
+		for _, file := range tlsFiles(svcCfg.Listener.TLS) {
+			t, err := w.modTime(file)
+			if err != nil {
+				continue
+			}
+			key := svcCfg.Name + "@" + file
+			last, ok := w.mtimes[key]
+			if !ok {
+				w.mtimes[key] = t
+				continue
+			}
+			if !t.Equal(last) {
+				modified[key] = t
+			}
+		}
+		if len(modified) == 0 {
+			continue
+		}
+		log.Infof("service %s: certificate modified, reloading", svcCfg.Name)
+		if err := w.reload(svcCfg); err != nil {
+			log.Errorf("service %s: reload: %v", svcCfg.Name, err)
+			continue
+		}
+		for key, t := range modified {
+			w.mtimes[key] = t
+		}
+	}
+}
+
+func fileModTime(file string) (time.Time, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func tlsFiles(cfg *config.TLSConfig) (files []string) {
+	for _, file := range []string{cfg.CertFile, cfg.KeyFile, cfg.CAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return
+}
+
+// reloadService restarts the service with the current content of its certificate files.
+// The running service is kept if the files can not be loaded.
+func reloadService(cfg *config.ServiceConfig) error {
+	if err := loadTLSFiles(cfg.Listener.TLS); err != nil {
+		return err
+	}
+
+	// the new service may listen on the same address, so the running one has to be closed first.
+	registry.ServiceRegistry().Unregister(cfg.Name)
+
+	svc, err := parsing.ParseService(cfg)
+	if err != nil {
+		return err
+	}
+	if err := registry.ServiceRegistry().Register(cfg.Name, svc); err != nil {
+		svc.Close()
+		return err
+	}
+	go func() {
+		svc.Serve()
+		svc.Close()
+	}()
+	return nil
+}
+
+// loadTLSFiles loads the certificate, key and CA files of the service TLS config
+// the same way as the service does, without starting the service.
+func loadTLSFiles(cfg *config.TLSConfig) error {
+	if cfg == nil || (cfg.CertFile == "" && cfg.KeyFile == "") {
+		return nil
+	}
+	if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+		return err
+	}
+	if cfg.CAFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return fmt.Errorf("%s: no certificate found", cfg.CAFile)
+	}
+	return nil
+}
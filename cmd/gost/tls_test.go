@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+func TestTLSWatcher(t *testing.T) {
+	watchedService := func(name, addr string) *config.ServiceConfig {
+		return &config.ServiceConfig{
+			Name: name,
+			Addr: addr,
+			Listener: &config.ListenerConfig{
+				Type: "tls",
+				TLS: &config.TLSConfig{
+					CertFile: "cert.pem",
+					KeyFile:  "key.pem",
+				},
+				Metadata: map[string]any{"tls.watch": true},
+			},
+		}
+	}
+
+	cfg := &config.Config{
+		Services: []*config.ServiceConfig{watchedService("service-0", ":8443")},
+	}
+	mtimes := map[string]time.Time{
+		"cert.pem": time.Unix(1, 0),
+		"key.pem":  time.Unix(1, 0),
+	}
+	var reloaded []*config.ServiceConfig
+	var reloadErr error
+	w := &tlsWatcher{
+		config: func() *config.Config { return cfg },
+		modTime: func(file string) (time.Time, error) {
+			if t, ok := mtimes[file]; ok {
+				return t, nil
+			}
+			return time.Time{}, os.ErrNotExist
+		},
+		reload: func(cfg *config.ServiceConfig) error {
+			reloaded = append(reloaded, cfg)
+			return reloadErr
+		},
+		mtimes: map[string]time.Time{},
+	}
+
+	w.check()
+	w.check()
+	if len(reloaded) != 0 {
+		t.Fatalf("unmodified files reloaded %d services", len(reloaded))
+	}
+
+	// the config is replaced, e.g. by a SIGHUP reload.
+	cfg = &config.Config{
+		Services: []*config.ServiceConfig{
+			watchedService("service-0", ":9443"),
+			watchedService("service-1", ":10443"),
+		},
+	}
+	mtimes["cert.pem"] = time.Unix(2, 0)
+	w.check()
+
+	// service-1 is seen for the first time, only service-0 is reloaded.
+	if len(reloaded) != 1 {
+		t.Fatalf("got %d reloaded services, want 1", len(reloaded))
+	}
+	if reloaded[0] != cfg.Services[0] {
+		t.Errorf("reloaded with config %+v, want the current config %+v", reloaded[0], cfg.Services[0])
+	}
+
+	mtimes["key.pem"] = time.Unix(3, 0)
+	reloaded = nil
+	w.check()
+	if len(reloaded) != 2 {
+		t.Errorf("got %d reloaded services, want 2", len(reloaded))
+	}
+
+	// a failed reload, e.g. with the key not yet replaced, is retried on the next check.
+	reloadErr = errors.New("private key does not match public key")
+	mtimes["cert.pem"] = time.Unix(4, 0)
+	reloaded = nil
+	w.check()
+	w.check()
+	if len(reloaded) != 4 {
+		t.Errorf("got %d reloads, want 4", len(reloaded))
+	}
+
+	reloadErr = nil
+	reloaded = nil
+	w.check()
+	w.check()
+	if len(reloaded) != 2 {
+		t.Errorf("got %d reloads, want 2", len(reloaded))
+	}
+}
+
+func TestReloadServiceKeepsRunning(t *testing.T) {
+	cfg := &config.ServiceConfig{
+		Name: "service-reload",
+		Listener: &config.ListenerConfig{
+			Type: "tls",
+			TLS: &config.TLSConfig{
+				CertFile: "/nonexistent.pem",
+				KeyFile:  "/nonexistent.key",
+			},
+		},
+	}
+	svc := &testService{}
+	if err := registry.ServiceRegistry().Register(cfg.Name, svc); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.ServiceRegistry().Unregister(cfg.Name)
+
+	if err := reloadService(cfg); err == nil {
+		t.Fatal("expected an error")
+	}
+	if registry.ServiceRegistry().Get(cfg.Name) != svc || svc.closed {
+		t.Error("the running service is not kept")
+	}
+}
+
+type testService struct {
+	closed bool
+}
+
+func (s *testService) Serve() error   { return nil }
+func (s *testService) Addr() net.Addr { return nil }
+func (s *testService) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/config/parsing"
+	"github.com/go-gost/x/registry"
+)
+
+// validateConfig checks cfg for duplicate names, references to undefined objects
+// and unknown handler, listener, connector or dialer types.
+// The components and the TLS files of the services are loaded as well, without creating any service.
+func validateConfig(cfg *config.Config) error {
+	if cfg == nil {
+		return nil
+	}
+
+	names := map[string]map[string]bool{}
+	define := func(kind, name string) error {
+		if names[kind] == nil {
+			names[kind] = map[string]bool{}
+		}
+		if names[kind][name] {
+			return fmt.Errorf("duplicate %s %s", kind, name)
+		}
+		names[kind][name] = true
+		return nil
+	}
+	for _, c := range cfg.Authers {
+		if err := define("auther", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Admissions {
+		if err := define("admission", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Bypasses {
+		if err := define("bypass", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Resolvers {
+		if err := define("resolver", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Hosts {
+		if err := define("hosts", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Recorders {
+		if err := define("recorder", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Limiters {
+		if err := define("limiter", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Chains {
+		if err := define("chain", c.Name); err != nil {
+			return err
+		}
+	}
+	for _, c := range cfg.Services {
+		if err := define("service", c.Name); err != nil {
+			return err
+		}
+	}
+
+	ref := func(kind string, refs ...string) error {
+		for _, name := range refs {
+			if name != "" && !names[kind][name] {
+				return fmt.Errorf("undefined %s %s", kind, name)
+			}
+		}
+		return nil
+	}
+
+	for _, chainCfg := range cfg.Chains {
+		for _, hop := range chainCfg.Hops {
+			if err := validateHop(hop, ref); err != nil {
+				return fmt.Errorf("chain %s: %w", chainCfg.Name, err)
+			}
+		}
+	}
+
+	for _, svc := range cfg.Services {
+		if err := validateService(svc, ref); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+
+	return parseComponents(cfg)
+}
+
+// parseComponents parses the components of cfg as buildService does, but does not register them.
+func parseComponents(cfg *config.Config) error {
+	var parsed []any
+	defer func() {
+		for _, v := range parsed {
+			if closer, ok := v.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}()
+
+	for _, c := range cfg.Authers {
+		parsed = append(parsed, parsing.ParseAuther(c))
+	}
+	for _, c := range cfg.Admissions {
+		parsed = append(parsed, parsing.ParseAdmission(c))
+	}
+	for _, c := range cfg.Bypasses {
+		parsed = append(parsed, parsing.ParseBypass(c))
+	}
+	for _, c := range cfg.Resolvers {
+		r, err := parsing.ParseResolver(c)
+		if err != nil {
+			return fmt.Errorf("resolver %s: %w", c.Name, err)
+		}
+		parsed = append(parsed, r)
+	}
+	for _, c := range cfg.Hosts {
+		parsed = append(parsed, parsing.ParseHosts(c))
+	}
+	for _, c := range cfg.Recorders {
+		parsed = append(parsed, parsing.ParseRecorder(c))
+	}
+	for _, c := range cfg.Limiters {
+		parsed = append(parsed, parsing.ParseRateLimiter(c))
+	}
+	for _, c := range cfg.Chains {
+		chain, err := parsing.ParseChain(c)
+		if err != nil {
+			return fmt.Errorf("chain %s: %w", c.Name, err)
+		}
+		parsed = append(parsed, chain)
+	}
+	return nil
+}
+
+func validateHop(hop *config.HopConfig, ref func(kind string, refs ...string) error) error {
+	if err := ref("bypass", append(hop.Bypasses, hop.Bypass)...); err != nil {
+		return err
+	}
+	if err := ref("resolver", hop.Resolver); err != nil {
+		return err
+	}
+	if err := ref("hosts", hop.Hosts); err != nil {
+		return err
+	}
+	for _, node := range hop.Nodes {
+		if err := validateNode(node, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateNode(node *config.NodeConfig, ref func(kind string, refs ...string) error) error {
+	if err := ref("bypass", append(node.Bypasses, node.Bypass)...); err != nil {
+		return err
+	}
+	if err := ref("resolver", node.Resolver); err != nil {
+		return err
+	}
+	if err := ref("hosts", node.Hosts); err != nil {
+		return err
+	}
+	if node.Connector != nil && registry.ConnectorRegistry().Get(node.Connector.Type) == nil {
+		return fmt.Errorf("node %s: unknown connector %s", node.Name, node.Connector.Type)
+	}
+	if node.Dialer != nil && registry.DialerRegistry().Get(node.Dialer.Type) == nil {
+		return fmt.Errorf("node %s: unknown dialer %s", node.Name, node.Dialer.Type)
+	}
+	return nil
+}
+
+func validateService(svc *config.ServiceConfig, ref func(kind string, refs ...string) error) error {
+	if err := ref("admission", append(svc.Admissions, svc.Admission)...); err != nil {
+		return err
+	}
+	if err := ref("bypass", append(svc.Bypasses, svc.Bypass)...); err != nil {
+		return err
+	}
+	if err := ref("resolver", svc.Resolver); err != nil {
+		return err
+	}
+	if err := ref("hosts", svc.Hosts); err != nil {
+		return err
+	}
+	if err := ref("limiter", svc.Limiter); err != nil {
+		return err
+	}
+	for _, rec := range svc.Recorders {
+		if err := ref("recorder", rec.Name); err != nil {
+			return err
+		}
+	}
+
+	if h := svc.Handler; h != nil {
+		if registry.HandlerRegistry().Get(h.Type) == nil {
+			return fmt.Errorf("unknown handler %s", h.Type)
+		}
+		if err := ref("chain", h.Chain); err != nil {
+			return err
+		}
+		if h.ChainGroup != nil {
+			if err := ref("chain", h.ChainGroup.Chains...); err != nil {
+				return err
+			}
+		}
+		if err := ref("auther", append(h.Authers, h.Auther)...); err != nil {
+			return err
+		}
+		if err := loadTLSFiles(h.TLS); err != nil {
+			return err
+		}
+	}
+	if ln := svc.Listener; ln != nil {
+		if registry.ListenerRegistry().Get(ln.Type) == nil {
+			return fmt.Errorf("unknown listener %s", ln.Type)
+		}
+		if err := ref("chain", ln.Chain); err != nil {
+			return err
+		}
+		if ln.ChainGroup != nil {
+			if err := ref("chain", ln.ChainGroup.Chains...); err != nil {
+				return err
+			}
+		}
+		if err := ref("auther", append(ln.Authers, ln.Auther)...); err != nil {
+			return err
+		}
+		if err := loadTLSFiles(ln.TLS); err != nil {
+			return err
+		}
+	}
+	if svc.Forwarder != nil {
+		for _, node := range svc.Forwarder.Nodes {
+			if err := validateNode(node, ref); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-gost/x/config"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *config.Config)
+		err    string
+	}{
+		{
+			name:   "valid",
+			modify: func(cfg *config.Config) {},
+		},
+		{
+			name: "duplicate service",
+			modify: func(cfg *config.Config) {
+				cfg.Services = append(cfg.Services, cfg.Services[0])
+			},
+			err: "duplicate service service-0",
+		},
+		{
+			name: "undefined chain",
+			modify: func(cfg *config.Config) {
+				cfg.Services[0].Handler.Chain = "chain-1"
+			},
+			err: "undefined chain chain-1",
+		},
+		{
+			name: "undefined bypass",
+			modify: func(cfg *config.Config) {
+				cfg.Services[0].Bypass = "bypass-0"
+			},
+			err: "undefined bypass bypass-0",
+		},
+		{
+			name: "undefined hop resolver",
+			modify: func(cfg *config.Config) {
+				cfg.Chains[0].Hops[0].Resolver = "resolver-0"
+			},
+			err: "undefined resolver resolver-0",
+		},
+		{
+			name: "unknown handler",
+			modify: func(cfg *config.Config) {
+				cfg.Services[0].Handler.Type = "unknown"
+			},
+			err: "unknown handler unknown",
+		},
+		{
+			name: "unknown dialer",
+			modify: func(cfg *config.Config) {
+				cfg.Chains[0].Hops[0].Nodes[0].Dialer.Type = "unknown"
+			},
+			err: "unknown dialer unknown",
+		},
+		{
+			name: "service certificate",
+			modify: func(cfg *config.Config) {
+				cfg.Services[0].Listener.TLS = &config.TLSConfig{
+					CertFile: "/nonexistent.pem",
+					KeyFile:  "/nonexistent.key",
+				}
+			},
+			err: "/nonexistent.pem",
+		},
+		{
+			name: "chain CA",
+			modify: func(cfg *config.Config) {
+				cfg.Chains[0].Hops[0].Nodes[0].Dialer.TLS = &config.TLSConfig{CAFile: "/nonexistent.ca"}
+			},
+			err: "chain chain-0: open /nonexistent.ca",
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := buildConfigFromCmd(stringList{"http://:8080"}, stringList{"socks5://1.2.3.4:1080"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.modify(cfg)
+		err = validateConfig(cfg)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}